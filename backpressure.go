@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	//log-opt
+	logzioBackpressure = "logzio-backpressure"
+
+	envBackpressure = "LOGZIO_BACKPRESSURE"
+
+	// backpressureBlock waits for room in the channel, which can stall the container writing to stdout
+	backpressureBlock = "block"
+	// backpressureDropNewest drops the message being logged when the channel is full
+	backpressureDropNewest = "drop-newest"
+	// backpressureDropOldest drops the oldest message in the channel to make room for the new one
+	backpressureDropOldest = "drop-oldest"
+	// backpressureSpillToDisk writes the message straight to the disk queue when the channel is full
+	backpressureSpillToDisk = "spill-to-disk"
+
+	defaultBackpressure     = backpressureBlock
+	backpressureReportEvery = time.Second * 10
+)
+
+// getBackpressure returns what to do with a message when the channel of the logger is full
+func getBackpressure(loggerInfo logger.Info) (string, error) {
+	mode := getOptOrEnv(loggerInfo, logzioBackpressure, envBackpressure)
+	switch mode {
+	case "":
+		return defaultBackpressure, nil
+	case backpressureBlock, backpressureDropNewest, backpressureDropOldest, backpressureSpillToDisk:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%s must be one of %s, %s, %s or %s: %s\n", logzioBackpressure,
+			backpressureBlock, backpressureDropNewest, backpressureDropOldest, backpressureSpillToDisk, mode)
+	}
+}
+
+// backpressureStats counts the messages that did not go through the channel.
+type backpressureStats struct {
+	dropped    uint64
+	spilled    uint64
+	lastReport int64
+}
+
+func (s *backpressureStats) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *backpressureStats) Spilled() uint64 {
+	return atomic.LoadUint64(&s.spilled)
+}
+
+// report logs the counters at most once every backpressureReportEvery, so a full channel doesn't flood the plugin log
+func (s *backpressureStats) report(containerID string, mode string) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&s.lastReport)
+	if now-last < int64(backpressureReportEvery) || !atomic.CompareAndSwapInt64(&s.lastReport, last, now) {
+		return
+	}
+	logrus.WithField("id", containerID).WithField("mode", mode).
+		Warningf("Logz.io logger: channel is full, dropped %d and spilled %d messages so far\n", s.Dropped(), s.Spilled())
+}
+
+// pushMessage puts the message in the channel according to the backpressure mode.
+// The caller holds the read lock, so the channel is not closed underneath.
+func (logzioLogger *LogzioLogger) pushMessage(msg *logDocument) error {
+	switch logzioLogger.backpressure {
+	case backpressureDropNewest:
+		select {
+		case logzioLogger.msgStream <- msg:
+		default:
+			atomic.AddUint64(&logzioLogger.bpStats.dropped, 1)
+			logzioLogger.bpStats.report(logzioLogger.containerID, logzioLogger.backpressure)
+		}
+	case backpressureDropOldest:
+		for {
+			select {
+			case logzioLogger.msgStream <- msg:
+				return nil
+			default:
+			}
+			select {
+			case <-logzioLogger.msgStream:
+				atomic.AddUint64(&logzioLogger.bpStats.dropped, 1)
+				logzioLogger.bpStats.report(logzioLogger.containerID, logzioLogger.backpressure)
+			default:
+			}
+		}
+	case backpressureSpillToDisk:
+		select {
+		case logzioLogger.msgStream <- msg:
+		default:
+			// the disk queue is what the channel feeds anyway, only the order with the buffered messages is lost
+			buf := getBuffer()
+			logzioLogger.encoder.encode(buf, msg)
+			err := logzioLogger.ship(buf.Bytes())
+			putBuffer(buf)
+			if err != nil {
+				return fmt.Errorf("error spilling to the disk queue: %s\n", err)
+			}
+			atomic.AddUint64(&logzioLogger.bpStats.spilled, 1)
+			logzioLogger.bpStats.report(logzioLogger.containerID, logzioLogger.backpressure)
+		}
+	default:
+		logzioLogger.msgStream <- msg
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+func newFullChannelLogger(mode string, sender *shipper.LogzioSender) *LogzioLogger {
+	logzioLogger := &LogzioLogger{
+		backpressure: mode,
+		bpStats:      &backpressureStats{},
+		containerID:  "containeriid",
+		encoder:      &docEncoder{},
+		logzioSender: sender,
+		msgStream:    make(chan *logDocument, 2),
+	}
+	logzioLogger.msgStream <- &logDocument{line: []byte("1")}
+	logzioLogger.msgStream <- &logDocument{line: []byte("2")}
+	return logzioLogger
+}
+
+func TestBackpressureBlock(t *testing.T) {
+	logzioLogger := newFullChannelLogger(backpressureBlock, nil)
+	done := make(chan error)
+	go func() {
+		done <- logzioLogger.sendMessageToChannel(&logDocument{line: []byte("3")})
+	}()
+	select {
+	case <-done:
+		t.Fatal("Block mode returned while the channel is full")
+	case <-time.After(time.Millisecond * 100):
+	}
+	<-logzioLogger.msgStream
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if logzioLogger.bpStats.Dropped() != 0 {
+		t.Fatalf("Block mode dropped %d messages", logzioLogger.bpStats.Dropped())
+	}
+}
+
+func TestBackpressureDrop(t *testing.T) {
+	for mode, expected := range map[string][]string{
+		backpressureDropNewest: {"1", "2"},
+		backpressureDropOldest: {"3", "4"},
+	} {
+		logzioLogger := newFullChannelLogger(mode, nil)
+		for _, m := range []string{"3", "4"} {
+			if err := logzioLogger.sendMessageToChannel(&logDocument{line: []byte(m)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if logzioLogger.bpStats.Dropped() != 2 {
+			t.Fatalf("%s: expected 2 dropped messages, got %d", mode, logzioLogger.bpStats.Dropped())
+		}
+		for _, m := range expected {
+			if msg := <-logzioLogger.msgStream; string(msg.line) != m {
+				t.Fatalf("%s: expected message %s, got %s", mode, m, msg.line)
+			}
+		}
+	}
+}
+
+func TestBackpressureSpillToDisk(t *testing.T) {
+	mock := NewtestHTTPMock(t, []int{http.StatusOK})
+	go mock.Serve()
+	defer mock.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	sender, err := shipper.New(mock.Token(),
+		shipper.SetTempDirectory(dir),
+		shipper.SetUrl(mock.URL()),
+		shipper.SetDrainDuration(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Stop()
+
+	logzioLogger := newFullChannelLogger(backpressureSpillToDisk, sender)
+	if err := logzioLogger.sendMessageToChannel(&logDocument{line: []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	if logzioLogger.bpStats.Spilled() != 1 || logzioLogger.bpStats.Dropped() != 0 {
+		t.Fatalf("Unexpected counters, spilled: %d dropped: %d", logzioLogger.bpStats.Spilled(), logzioLogger.bpStats.Dropped())
+	}
+	if length := sender.Stats().QueueLength; length != 1 {
+		t.Fatalf("Expected the message in the disk queue, queue length %d", length)
+	}
+	if len(logzioLogger.msgStream) != 2 {
+		t.Fatalf("Channel length is not as expected: %d", len(logzioLogger.msgStream))
+	}
+}
+
+func TestInvalidBackpressure(t *testing.T) {
+	_, err := validateDriverOpt(logger.Info{Config: map[string]string{
+		logzioToken:        "123456789",
+		logzioDirPath:      fmt.Sprintf("./%s", t.Name()),
+		logzioBackpressure: "drop-all",
+	}})
+	if err == nil {
+		t.Fatal("Expected an error for an unknown backpressure mode")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+const (
+	//log-opt
+	logzioBreakerFailures    = "logzio-breaker-failures"
+	logzioBreakerErrorRate   = "logzio-breaker-error-rate"
+	logzioBreakerWindow      = "logzio-breaker-window"
+	logzioBreakerOpenTimeout = "logzio-breaker-open-timeout"
+
+	envBreakerFailures    = "LOGZIO_BREAKER_FAILURES"
+	envBreakerErrorRate   = "LOGZIO_BREAKER_ERROR_RATE"
+	envBreakerWindow      = "LOGZIO_BREAKER_WINDOW"
+	envBreakerOpenTimeout = "LOGZIO_BREAKER_OPEN_TIMEOUT"
+)
+
+// getBreakerPolicy builds the circuit breaker policy of the sender from the log-opts, falling back to the plugin env
+func getBreakerPolicy(loggerInfo logger.Info) (shipper.BreakerPolicy, error) {
+	policy := shipper.DefaultBreakerPolicy()
+	var err error
+
+	for _, i := range []struct {
+		opt   string
+		env   string
+		value *int
+	}{
+		{logzioBreakerFailures, envBreakerFailures, &policy.ConsecutiveFailures},
+		{logzioBreakerWindow, envBreakerWindow, &policy.Window},
+	} {
+		if str := getOptOrEnv(loggerInfo, i.opt, i.env); str != "" {
+			if *i.value, err = strconv.Atoi(str); err != nil {
+				return policy, fmt.Errorf("%s is not a valid number: %s\n", i.opt, str)
+			}
+		}
+	}
+
+	if str := getOptOrEnv(loggerInfo, logzioBreakerErrorRate, envBreakerErrorRate); str != "" {
+		if policy.ErrorRate, err = strconv.ParseFloat(str, 64); err != nil {
+			return policy, fmt.Errorf("%s is not a valid number: %s\n", logzioBreakerErrorRate, str)
+		}
+	}
+
+	if str := getOptOrEnv(loggerInfo, logzioBreakerOpenTimeout, envBreakerOpenTimeout); str != "" {
+		if policy.OpenTimeout, err = time.ParseDuration(str); err != nil {
+			return policy, fmt.Errorf("%s is not a valid duration: %s\n", logzioBreakerOpenTimeout, str)
+		}
+	}
+
+	if err := policy.Validate(); err != nil {
+		return policy, fmt.Errorf("invalid circuit breaker policy: %s\n", err)
+	}
+	return policy, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// command is run by the plugin binary instead of serving the socket, e.g.
+// logzio-logging-plugin dead-letter ls --dir <logzio-dir-path>
+type command func(args []string, out io.Writer) error
+
+var commands = map[string]command{
+	"dead-letter":  deadLetterCommand,
+	"listener-sim": listenerSimCommand,
+	"load":         loadCommand,
+	"queue":        queueCommand,
+	"status":       statusCommand,
+}
+
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
+		printUsage(os.Stderr)
+		return 2
+	}
+	if err := cmd(args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func printUsage(out io.Writer) {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(out, "usage: logzio-logging-plugin [command]")
+	fmt.Fprintln(out, "without a command the plugin serves the docker socket, commands:")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", name)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+const (
+	//log-opt
+	logzioEncryptionKeyFile = "logzio-encryption-key-file"
+
+	envEncryptionKeyFile = "LOGZIO_ENCRYPTION_KEY_FILE"
+	// envEncryptionKey holds the keys themselves, there is no log-opt for it since log-opts show in docker inspect
+	envEncryptionKey = "LOGZIO_ENCRYPTION_KEY"
+)
+
+// getKeyring returns the keys that encrypt the disk queue, or nil when encryption at rest is off
+func getKeyring(loggerInfo logger.Info) (*shipper.Keyring, error) {
+	if keyFile := getOptOrEnv(loggerInfo, logzioEncryptionKeyFile, envEncryptionKeyFile); keyFile != "" {
+		keys, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s\n", logzioEncryptionKeyFile, err)
+		}
+		keyring, err := shipper.ParseKeyring(string(keys))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s: %s\n", logzioEncryptionKeyFile, keyFile, err)
+		}
+		return keyring, nil
+	}
+	if keys := os.Getenv(envEncryptionKey); keys != "" {
+		keyring, err := shipper.ParseKeyring(keys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s\n", envEncryptionKey, err)
+		}
+		return keyring, nil
+	}
+	return nil, nil
+}
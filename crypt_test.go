@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func TestKeyringOptions(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	if keyring, err := getKeyring(logger.Info{}); keyring != nil || err != nil {
+		t.Fatalf("Expected no encryption by default: %v", err)
+	}
+
+	os.Setenv(envEncryptionKey, "from-env:"+key)
+	defer os.Unsetenv(envEncryptionKey)
+	keyring, err := getKeyring(logger.Info{})
+	if err != nil || keyring.CurrentKeyID() != "from-env" {
+		t.Fatalf("Unexpected keyring from env: %v", err)
+	}
+
+	keyFile := writeTestFile(t, dir, "keys", []byte(fmt.Sprintf("old:%s\nfrom-file:%s\n", key, key)))
+	keyring, err = getKeyring(logger.Info{Config: map[string]string{logzioEncryptionKeyFile: keyFile}})
+	if err != nil || keyring.CurrentKeyID() != "from-file" {
+		t.Fatalf("Unexpected keyring from file: %v", err)
+	}
+
+	badFile := writeTestFile(t, dir, "bad", []byte("k:"+base64.StdEncoding.EncodeToString([]byte("short"))))
+	for _, file := range []string{badFile, dir + "/missing"} {
+		_, err := validateDriverOpt(logger.Info{Config: map[string]string{
+			logzioToken:             "123456789",
+			logzioDirPath:           dir,
+			logzioEncryptionKeyFile: file,
+		}})
+		if err == nil {
+			t.Fatalf("Expected an error for key file %s", file)
+		}
+	}
+}
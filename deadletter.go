@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+const deadLetterDirName = "dead-letter"
+
+func deadLetterDir(dir string, hashCode string) string {
+	return filepath.Join(dir, deadLetterDirName, hashCode)
+}
+
+// deadLetterCommand inspects and resubmits the batches dead-lettered under a logzio-dir-path
+func deadLetterCommand(args []string, out io.Writer) error {
+	usage := "usage: dead-letter ls|dump|resubmit --dir <logzio-dir-path> [--hash <queue>] [--key-file <path>] [--url <url> --token <token>]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	flags := flag.NewFlagSet("dead-letter "+args[0], flag.ContinueOnError)
+	dir := flags.String("dir", "", "logzio-dir-path of the containers")
+	hashCode := flags.String("hash", "", "only this queue, all queues when empty")
+	urlStr := flags.String("url", "", "listener url to resubmit to")
+	token := flags.String("token", "", "token to resubmit with")
+	debug := flags.Bool("debug", false, "print the sender debug logs")
+	keyFile := flags.String("key-file", "", "encryption keys of the records, defaults to "+envEncryptionKeyFile+" or "+envEncryptionKey)
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New(usage)
+	}
+	keyring, err := getKeyring(logger.Info{Config: keyFileConfig(*keyFile)})
+	if err != nil {
+		return err
+	}
+
+	queues, err := deadLetterQueues(*dir, *hashCode)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "ls":
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "QUEUE\tTIME\tSTATUS\tREASON\tATTEMPTS\tLINES\tBYTES\tFILE")
+		for _, queue := range queues {
+			records, err := shipper.ReadDeadLetters(deadLetterDir(*dir, queue))
+			if err != nil {
+				return err
+			}
+			for _, r := range records {
+				// without the key only the size of an encrypted batch is known
+				lines := "-"
+				if err := r.Decrypt(keyring); err == nil {
+					lines = strconv.Itoa(r.Lines())
+				}
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\t%d\t%s\n", queue, r.Time.Format(time.RFC3339), r.StatusCode,
+					r.Reason, r.Attempts, lines, len(r.Payload), filepath.Base(r.Path))
+			}
+		}
+		return w.Flush()
+	case "dump":
+		enc := json.NewEncoder(out)
+		for _, queue := range queues {
+			records, err := shipper.ReadDeadLetters(deadLetterDir(*dir, queue))
+			if err != nil {
+				return err
+			}
+			for _, r := range records {
+				if err := r.Decrypt(keyring); err != nil {
+					return fmt.Errorf("%s: %s", r.Path, err)
+				}
+				if err := enc.Encode(r); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case "resubmit":
+		if *urlStr == "" || *token == "" {
+			return errors.New("resubmit requires --url and --token")
+		}
+		tmpDir, err := ioutil.TempDir("", "logzio-resubmit")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		var debugWriter io.Writer
+		if *debug {
+			debugWriter = os.Stderr
+		}
+		for _, queue := range queues {
+			// batches rejected again stay in the same dead-letter queue
+			sender, err := shipper.New(*token,
+				shipper.SetUrl(*urlStr),
+				shipper.SetDebug(debugWriter),
+				shipper.SetTempDirectory(filepath.Join(tmpDir, queue)),
+				shipper.SetDeadLetterDirectory(deadLetterDir(*dir, queue)),
+				shipper.SetKeyring(keyring))
+			if err != nil {
+				return err
+			}
+			sent, err := sender.ResubmitDeadLetters(deadLetterDir(*dir, queue))
+			sender.Stop()
+			fmt.Fprintf(out, "%s: resubmitted %d batches\n", queue, sent)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return errors.New(usage)
+	}
+}
+
+// keyFileConfig returns the log-opts of a --key-file flag, so the plugin env applies when it is empty
+func keyFileConfig(keyFile string) map[string]string {
+	if keyFile == "" {
+		return nil
+	}
+	return map[string]string{logzioEncryptionKeyFile: keyFile}
+}
+
+// deadLetterQueues returns the queues that have a dead-letter dir
+func deadLetterQueues(dir string, hashCode string) ([]string, error) {
+	if hashCode != "" {
+		return []string{hashCode}, nil
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, deadLetterDirName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var queues []string
+	for _, f := range files {
+		if f.IsDir() {
+			queues = append(queues, f.Name())
+		}
+	}
+	return queues, nil
+}
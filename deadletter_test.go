@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+func TestDeadLetterAndResubmit(t *testing.T) {
+	rejecting := NewtestHTTPMock(t, []int{http.StatusUnauthorized})
+	go rejecting.Serve()
+	defer rejecting.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	info := logger.Info{
+		Config: map[string]string{
+			logzioURL:     rejecting.URL(),
+			logzioToken:   "badToken",
+			logzioDirPath: dir,
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+	hashCode, err := validateDriverOpt(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logziol, err := newLogzioLogger(info, nil, hashCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := logziol.Log(&logger.Message{Line: []byte(fmt.Sprintf("%s%d", t.Name(), i)), Source: "stdout",
+			Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Failed Log string: %s", err)
+		}
+	}
+	if err := logziol.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := shipper.ReadDeadLetters(deadLetterDir(dir, hashCode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 dead-lettered batch, found %d", len(records))
+	}
+	if records[0].StatusCode != http.StatusUnauthorized || records[0].Lines() != 3 || records[0].Time.IsZero() {
+		t.Fatalf("Unexpected dead letter: %+v", records[0])
+	}
+
+	var out bytes.Buffer
+	if err := deadLetterCommand([]string{"ls", "--dir", dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), hashCode) || !strings.Contains(out.String(), "401") {
+		t.Fatalf("Unexpected ls output: %s", out.String())
+	}
+
+	out.Reset()
+	if err := deadLetterCommand([]string{"dump", "--dir", dir, "--hash", hashCode}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), t.Name()+"2") {
+		t.Fatalf("Unexpected dump output: %s", out.String())
+	}
+
+	accepting := NewtestHTTPMock(t, []int{http.StatusOK})
+	go accepting.Serve()
+	defer accepting.Close()
+	out.Reset()
+	if err := deadLetterCommand([]string{"resubmit", "--dir", dir, "--url", accepting.URL(), "--token", accepting.Token()}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(accepting.messages) != 3 || accepting.messages[0]["message"] != t.Name()+"0" {
+		t.Fatalf("Unexpected resubmitted messages: %v", accepting.messages)
+	}
+	if records, _ := shipper.ReadDeadLetters(deadLetterDir(dir, hashCode)); len(records) != 0 {
+		t.Fatalf("Resubmitted batches were not removed: %d left", len(records))
+	}
+}
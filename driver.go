@@ -21,10 +21,9 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/docker/api/types/plugins/logdriver"
 	"github.com/docker/docker/daemon/logger"
-	"github.com/docker/docker/daemon/logger/jsonfilelog"
 	"github.com/docker/docker/daemon/logger/loggerutils"
-	"github.com/logzio/logzio-go"
 	"github.com/fatih/structs"
+	"github.com/logzio/logzio-logging-plugin/shipper"
 	"github.com/pkg/errors"
 	"github.com/tonistiigi/fifo"
 
@@ -58,7 +57,6 @@ const (
 	defaultDiskThreshould             = 98
 	defaultStreamChannelSize          = 10 * 1000
 	defaultPartialBufferTimerDuration = time.Millisecond * 500
-	defaultFlushPartialBuffer         = time.Second * 5
 	defaultDebug					  = false
 
 	defaultFormat     = "text"
@@ -67,18 +65,26 @@ const (
 	jsonFormat        = "json"
 )
 
+// retrySleep waits between the attempts to send a batch, tests set it to skip the wait. When it is
+// nil the sender waits on its own, and closing the sender cuts the wait short.
+var retrySleep func(time.Duration)
+
 type Driver struct {
 	idx     map[string]*ContainerLoggersCtx
 	logger  logger.Logger
 	logs    map[string]*ContainerLoggersCtx
 	mu      sync.Mutex // Protecting concurrency access for driver's maps
 	senders map[string]*SenderConfigurations
+	// stateFile is where the containers and senders are saved, empty doesn't save them
+	stateFile string
+	// queued are the queues of a previous run that wait for a container with their token
+	queued []senderState
 }
 
 type ContainerLoggersCtx struct {
 	info         logger.Info
-	jsonLogger   logger.Logger
-	logzioLogger LogzioLogger
+	localLogger  logger.Logger
+	logzioLogger *LogzioLogger
 	stream       io.ReadCloser
 }
 
@@ -93,23 +99,29 @@ type LogzioMessage struct {
 
 type LogzioLogger struct {
 	logger.Logger
+	backpressure      string
+	bpStats           *backpressureStats
 	closed            bool
 	closedDriverCond  *sync.Cond
-	logzioSender      *logzio.LogzioSender
+	containerID       string
+	containerName     string
+	dryRun            *dryRunWriter
+	encoder           *docEncoder
+	encoders          *encodePool
+	logzioSender      *shipper.LogzioSender
 	lock              sync.RWMutex
 	logFormat         string
 	maxMsgBufferSize  int
-	msg               map[string]interface{}
-	msgStream         chan map[string]interface{}
+	msgStream         chan *logDocument
+	oversize          string
 	partialBufTimeout time.Duration
-	pBuf              *PartialBuffer
 	url               string
 }
 
 type SenderConfigurations struct {
 	info     logger.Info
 	hashCode string
-	sender   *logzio.LogzioSender
+	sender   *shipper.LogzioSender
 }
 
 func newDriver() *Driver {
@@ -117,58 +129,40 @@ func newDriver() *Driver {
 		logs:    make(map[string]*ContainerLoggersCtx),
 		idx:     make(map[string]*ContainerLoggersCtx),
 		senders: make(map[string]*SenderConfigurations),
+		// the state file of the previous run is read before the containers start again
+		stateFile: stateFilePath(),
 	}
-	go driver.flushPartialBuffers()
-	return driver
-}
-
-func (d *Driver) flushPartialBuffers() {
-	timeout := defaultFlushPartialBuffer
-	for {
-		for containerID, containerLoggerInfo := range d.idx {
-			d.mu.Lock()
-			if _, ok := d.idx[containerID]; !ok {
-				d.mu.Unlock()
-				continue
-			}
-			logzioLogger := containerLoggerInfo.logzioLogger
-			delta := time.Now().Sub(logzioLogger.pBuf.startTime)
-			if delta > logzioLogger.pBuf.timeout {
-				var msg logger.Message
-				msg.Line = logzioLogger.pBuf.buf
-				msg.Source = logzioLogger.pBuf.source
-				msg.Timestamp = time.Unix(0, logzioLogger.pBuf.timeNano)
-
-				if err := logzioLogger.Log(&msg); err != nil {
-					logrus.WithField("id", containerID).WithError(err).WithField("message", msg).
-						Error("Logz.io logger:error writing log message")
-				}
-			}
-			d.mu.Unlock()
-		}
-		time.Sleep(timeout)
+	if err := tokenRotations.load(os.Getenv(envTokenRotationFile)); err != nil {
+		logrus.Error(err)
 	}
+	driver.restoreState()
+	go driver.refreshTokensLoop()
+	return driver
 }
 
+// validateDriverOpt checks every log-opt and returns all the problems found in one error,
+// so the container fails to start with the full list
 func validateDriverOpt(loggerInfo logger.Info) (string, error) {
 	config := loggerInfo.Config
 	// Config in logger.info is map[string]string
-	for opt := range config {
-		switch opt {
-		case logzioFormat, logzioLogSource, logzioTag, logzioToken, logzioType, logzioURL, logzioDirPath,
-			envRegex, dockerLabels, dockerEnv, logzioLogAttr:
-		default:
-			return "", fmt.Errorf("wrong log-opt: '%s' - %s\n", opt, loggerInfo.ContainerID)
-		}
+	problems := checkOpts(loggerInfo)
+	if _, ok := config[logzioDirPath]; !ok {
+		problems = append(problems, fmt.Sprintf("logz.io dir path is required. config: %v+\n", maskConfig(config)))
 	}
-	_, ok := config[logzioDirPath]
-	if !ok {
-		return "", fmt.Errorf("logz.io dir path is required. config: %v+\n", config)
+
+	token, err := getToken(loggerInfo)
+	if err != nil {
+		problems = append(problems, err.Error())
 	}
 
-	token, ok := config[logzioToken]
-	if !ok {
-		return "", fmt.Errorf("logz.io token is required\n")
+	// the options that depend on each other, and the files they name, are checked once every value is valid
+	if len(problems) == 0 {
+		if err := validateOptValues(loggerInfo); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		return "", errors.New(strings.Join(problems, ""))
 	}
 
 	hashCode := hash(token, config[logzioDirPath])
@@ -176,6 +170,50 @@ func validateDriverOpt(loggerInfo logger.Info) (string, error) {
 	return hashCode, nil
 }
 
+// validateOptValues checks the values of the sender and logger options, the options that are not set are not checked
+func validateOptValues(loggerInfo logger.Info) error {
+	if _, err := getTLSConfig(loggerInfo); err != nil {
+		return err
+	}
+
+	if _, err := getProxy(loggerInfo); err != nil {
+		return err
+	}
+
+	if _, err := getRetryPolicy(loggerInfo); err != nil {
+		return err
+	}
+
+	if _, err := getBreakerPolicy(loggerInfo); err != nil {
+		return err
+	}
+
+	if _, err := getBackpressure(loggerInfo); err != nil {
+		return err
+	}
+
+	if _, _, err := getQueueQuota(loggerInfo); err != nil {
+		return err
+	}
+
+	if _, err := getKeyring(loggerInfo); err != nil {
+		return err
+	}
+
+	if _, err := getPreflight(loggerInfo); err != nil {
+		return err
+	}
+
+	if _, _, err := getDryRun(loggerInfo); err != nil {
+		return err
+	}
+
+	if _, err := getLocalLog(loggerInfo); err != nil {
+		return err
+	}
+	return nil
+}
+
 func getTags(loggerInfo logger.Info) (string, error) {
 	tag := ""
 	var err error
@@ -252,14 +290,14 @@ func getEnvDuration(env string, dValue time.Duration) time.Duration {
 	// Getenv retrieves the value of the environment variable named by the key.
 	// It returns the value, which will be empty if the variable is not present.
 	eDuration := os.Getenv(env)
-	retDuration := defaultLogsDrainTimeout
+	retDuration := dValue
 	if eDuration != "" {
 		var err error
 		retDuration, err = time.ParseDuration(eDuration)
 		if err != nil {
-			logrus.Error(fmt.Sprintf("Error parsing drain timeout %s\n", err))
-			logrus.Info(fmt.Sprintf("Using default drain timeout %+v\n", dValue))
-			return defaultLogsDrainTimeout
+			logrus.Error(fmt.Sprintf("Error parsing %s %s\n", env, err))
+			logrus.Info(fmt.Sprintf("Using default %s %+v\n", env, dValue))
+			return dValue
 		}
 	}
 	return retDuration
@@ -281,7 +319,7 @@ func getEnvBool(env string, dValue bool) bool {
 	return retVal
 }
 
-func newLogzioSender(loggerInfo logger.Info, token string, sender *logzio.LogzioSender, hashCode string) (*logzio.LogzioSender, error) {
+func newLogzioSender(loggerInfo logger.Info, token string, sender *shipper.LogzioSender, hashCode string) (*shipper.LogzioSender, error) {
 	if sender != nil {
 		return sender, nil
 	}
@@ -290,17 +328,56 @@ func newLogzioSender(loggerInfo logger.Info, token string, sender *logzio.Logzio
 	dir, _ := loggerInfo.Config[logzioDirPath]
 	eDiskThreshold := getEnvInt(envDiskThreshold, defaultDiskThreshould)
 
+	tlsConfig, err := getTLSConfig(loggerInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := getProxy(loggerInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	retryPolicy, err := getRetryPolicy(loggerInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	breakerPolicy, err := getBreakerPolicy(loggerInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	queueMaxSize, eviction, err := getQueueQuota(loggerInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := getKeyring(loggerInfo)
+	if err != nil {
+		return nil, err
+	}
+
 	debugWriter := os.Stderr
 	if debug := getEnvBool(envDebug, defaultDebug); !debug {
 		debugWriter = nil
 	}
 
-	lsender, err := logzio.New(token,
-		logzio.SetDebug(debugWriter),
-		logzio.SetUrl(urlStr),
-		logzio.SetDrainDiskThreshold(eDiskThreshold),
-		logzio.SetTempDirectory(fmt.Sprintf("%s%s%s", dir, string(os.PathSeparator), hashCode)),
-		logzio.SetDrainDuration(drainDuration))
+	lsender, err := shipper.New(token,
+		shipper.SetDebug(debugWriter),
+		shipper.SetUrl(urlStr),
+		shipper.SetTLSConfig(tlsConfig),
+		shipper.SetProxy(proxy),
+		shipper.SetRetryPolicy(retryPolicy),
+		shipper.SetSleep(retrySleep),
+		shipper.SetBreakerPolicy(breakerPolicy),
+		shipper.SetDeadLetterDirectory(deadLetterDir(dir, hashCode)),
+		shipper.SetQueueQuota(queueMaxSize, eviction),
+		shipper.SetDiskQuota(globalDiskQuota),
+		shipper.SetKeyring(keyring),
+		shipper.SetDrainDiskThreshold(eDiskThreshold),
+		shipper.SetTempDirectory(fmt.Sprintf("%s%s%s", dir, string(os.PathSeparator), hashCode)),
+		shipper.SetDrainDuration(drainDuration))
 	logrus.Debugf("Creating new logger for container %s\n", loggerInfo.ContainerID)
 	return lsender, err
 }
@@ -315,8 +392,11 @@ func hash(args ...string) string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-func newLogzioLogger(loggerInfo logger.Info, sender *logzio.LogzioSender, hashCode string) (*LogzioLogger, error) {
-	optToken := loggerInfo.Config[logzioToken]
+func newLogzioLogger(loggerInfo logger.Info, sender *shipper.LogzioSender, hashCode string) (*LogzioLogger, error) {
+	optToken, err := getToken(loggerInfo)
+	if err != nil {
+		return nil, err
+	}
 
 	hostname, err := getHostname(loggerInfo)
 	if err != nil {
@@ -342,9 +422,25 @@ func newLogzioLogger(loggerInfo logger.Info, sender *logzio.LogzioSender, hashCo
 		sourceType = defaultSourceType
 	}
 	logSource := loggerInfo.Config[logzioLogSource]
+	backpressure, err := getBackpressure(loggerInfo)
+	if err != nil {
+		return nil, err
+	}
+	var dryRunWriter *dryRunWriter
+	if dryRun, dryRunFile, err := getDryRun(loggerInfo); err != nil {
+		return nil, err
+	} else if dryRun {
+		if dryRunWriter, err = openDryRun(dryRunFile); err != nil {
+			return nil, err
+		}
+	}
 	streamSize := getEnvInt(envChannelSize, defaultStreamChannelSize)
 	maxMsgBufferSize := getEnvInt(envMaxMsgBufferSize, defaultMaxMsgBufferSize)
 	partialBufferTimeout := getEnvDuration(envPartialBufferTimerDuration, defaultPartialBufferTimerDuration)
+	oversize := getOptOrEnv(loggerInfo, logzioOversize, envOversize)
+	if oversize == "" {
+		oversize = defaultOversize
+	}
 	defaultMsg := structs.Map(&LogzioMessage{
 		Host:      hostname,
 		LogSource: logSource,
@@ -358,6 +454,10 @@ func newLogzioLogger(loggerInfo logger.Info, sender *logzio.LogzioSender, hashCo
 	for key, value := range extra {
 		defaultMsg[key] = value
 	}
+	encoder, err := newDocEncoder(defaultMsg, format)
+	if err != nil {
+		return nil, err
+	}
 
 	logzioSender, err := newLogzioSender(loggerInfo, optToken, sender, hashCode)
 	if err != nil {
@@ -365,11 +465,18 @@ func newLogzioLogger(loggerInfo logger.Info, sender *logzio.LogzioSender, hashCo
 	}
 
 	logzioLogger := &LogzioLogger{
+		backpressure:      backpressure,
+		bpStats:           &backpressureStats{},
+		containerID:       loggerInfo.ContainerID,
+		containerName:     loggerInfo.Name(),
+		dryRun:            dryRunWriter,
+		encoder:           encoder,
+		encoders:          sharedEncodePool(),
 		logzioSender:      logzioSender,
 		logFormat:         format,
 		maxMsgBufferSize:  maxMsgBufferSize,
-		msg:               defaultMsg,
-		msgStream:         make(chan map[string]interface{}, streamSize),
+		msgStream:         make(chan *logDocument, streamSize),
+		oversize:          oversize,
 		partialBufTimeout: partialBufferTimeout,
 	}
 
@@ -378,13 +485,35 @@ func newLogzioLogger(loggerInfo logger.Info, sender *logzio.LogzioSender, hashCo
 }
 
 func (logzioLogger *LogzioLogger) sendToLogzio() {
+	batch := make([]*logDocument, 0, encodeBatchSize)
+	bufs := make([]*bytes.Buffer, encodeBatchSize)
 	for {
-		msg, open := <-logzioLogger.msgStream
+		doc, open := <-logzioLogger.msgStream
 		if open {
-			if data, err := json.Marshal(msg); err != nil {
-				logrus.Error(fmt.Sprintf("Error marshalling json object: %s\n", err.Error()))
-			} else if err := logzioLogger.logzioSender.Send(data); err != nil {
-				logrus.Error(fmt.Sprintf("Error enqueue object: %s\n", err))
+			batch = append(batch[:0], doc)
+			// the documents that are already in the channel are encoded together
+		fill:
+			for len(batch) < encodeBatchSize {
+				select {
+				case doc, open := <-logzioLogger.msgStream:
+					if !open {
+						break fill
+					}
+					batch = append(batch, doc)
+				default:
+					break fill
+				}
+			}
+			for i := range batch {
+				bufs[i] = getBuffer()
+			}
+			logzioLogger.encoders.encode(logzioLogger.encoder, batch, bufs[:len(batch)])
+			for i := range batch {
+				if err := logzioLogger.ship(bufs[i].Bytes()); err != nil {
+					logrus.Error(fmt.Sprintf("Error enqueue object: %s\n", err))
+				}
+				putBuffer(bufs[i])
+				bufs[i], batch[i] = nil, nil
 			}
 		} else {
 			logzioLogger.logzioSender.Stop()
@@ -399,15 +528,22 @@ func (logzioLogger *LogzioLogger) sendToLogzio() {
 	}
 }
 
-func (logzioLogger *LogzioLogger) sendMessageToChannel(msg map[string]interface{}) error {
+// ship queues a document for the sender, or writes it to the dry-run file instead
+func (logzioLogger *LogzioLogger) ship(data []byte) error {
+	if logzioLogger.dryRun != nil {
+		return logzioLogger.dryRun.write(logzioLogger.containerID, "", data)
+	}
+	return logzioLogger.logzioSender.Send(data)
+}
+
+func (logzioLogger *LogzioLogger) sendMessageToChannel(doc *logDocument) error {
 	logzioLogger.lock.RLock()
 	defer logzioLogger.lock.RUnlock()
 	// if Driver is closed return error
 	if logzioLogger.closedDriverCond != nil {
 		return fmt.Errorf("can't send the log to the channel - Driver is closed\n")
 	}
-	logzioLogger.msgStream <- msg
-	return nil
+	return logzioLogger.pushMessage(doc)
 }
 
 func (logzioLogger *LogzioLogger) Log(msg *logger.Message) error {
@@ -415,27 +551,21 @@ func (logzioLogger *LogzioLogger) Log(msg *logger.Message) error {
 		logrus.Debug("Discard empty string")
 		return nil
 	}
-	logMessage := make(map[string]interface{})
-	for index, element := range logzioLogger.msg {
-		logMessage[index] = element
-	}
-	logMessage["driver_timestamp"] = time.Unix(0, msg.Timestamp.UnixNano()).Format(time.RFC3339Nano)
-	logMessage["log_source"] = msg.Source
-	format := logzioLogger.logFormat
-	if format == defaultFormat {
-		logMessage["message"] = string(msg.Line)
-	} else {
-		// use of RawMessage: http://goinbigdata.com/how-to-correctly-serialize-json-string-in-golang/
-		var jsonLogLine json.RawMessage
-		if err := json.Unmarshal(msg.Line, &jsonLogLine); err == nil {
-			logMessage["message"] = &jsonLogLine
-			logMessage["logzio_codec"] = "json"
-		} else {
-			// do not try to fight it
-			logMessage["message"] = string(msg.Line)
-		}
+	line, keep := pluginConfigs.filter(logzioLogger.containerName, msg.Source, msg.Line)
+	if !keep {
+		return nil
+	}
+	// the document is encoded later by sendToLogzio, it keeps its own copy of the line
+	doc := &logDocument{
+		timestamp: msg.Timestamp,
+		source:    msg.Source,
+		line:      append([]byte(nil), line...),
+		partial:   partialFields(msg.Attrs),
+	}
+	if !pluginConfigs.route(logzioLogger, msg.Source, line, doc) {
+		return nil
 	}
-	err := logzioLogger.sendMessageToChannel(logMessage)
+	err := logzioLogger.sendMessageToChannel(doc)
 	return err
 }
 
@@ -448,6 +578,10 @@ func (logzioLogger *LogzioLogger) Close() error {
 		for !logzioLogger.closed {
 			logzioLogger.closedDriverCond.Wait()
 		}
+		if dropped, spilled := logzioLogger.bpStats.Dropped(), logzioLogger.bpStats.Spilled(); dropped+spilled > 0 {
+			logrus.WithField("id", logzioLogger.containerID).
+				Warningf("Logz.io logger: dropped %d and spilled %d messages while the channel was full\n", dropped, spilled)
+		}
 	}
 	return nil
 }
@@ -456,10 +590,16 @@ func (logzioLogger *LogzioLogger) Name() string {
 	return driverName
 }
 
-func (d *Driver) checkHashCodeExists(hashCode string, token string) *logzio.LogzioSender {
+func (d *Driver) checkHashCodeExists(hashCode string, token string) *shipper.LogzioSender {
+	// refreshTokens moves the senders to their new tokens in the background
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	if _, ok := d.senders[token]; ok {
-		if hashCode != d.senders[token].hashCode {
-			logrus.Error(fmt.Sprintf("Can use only one configuration set per token: %+v\n", d.senders[token].info))
+		// the sender of a rotated token keeps the queue of its first token, so the config is compared instead
+		if hashCode != hash(token, d.senders[token].info.Config[logzioDirPath]) {
+			info := d.senders[token].info
+			info.Config = maskConfig(info.Config)
+			logrus.Error(fmt.Sprintf("Can use only one configuration set per token: %+v\n", info))
 		}
 		return d.senders[token].sender
 	}
@@ -484,37 +624,85 @@ func (d *Driver) StartLogging(file string, logCtx logger.Info) error {
 		return errors.Wrapf(err, "error setting up logger dir\n")
 	}
 
-	jsonLogger, err := jsonfilelog.New(logCtx)
-	if err != nil {
-		return errors.Wrap(err, "error creating jsonfile logger\n")
-	}
-
 	logrus.WithField("id", logCtx.ContainerID).WithField("file", file).WithField("logpath", logCtx.LogPath).Debugf("Start logging")
 	f, err := fifo.OpenFifo(context.Background(), file, syscall.O_RDONLY, 0700)
 	if err != nil {
 		return errors.Wrapf(err, "error opening logger fifo: %q\n", file)
 	}
 
+	// the log-opts of the container override the defaults of the config file
+	logCtx.Config = pluginConfigs.withDefaults(logCtx.Config)
 	hashCode, err := validateDriverOpt(logCtx)
 	if err != nil {
-		return errors.Wrap(err, "error in one of the logger options\n")
+		f.Close()
+		return fmt.Errorf("invalid log-opts:\n%s", err)
+	}
+
+	// the copy read by docker logs, nil with logzio-local-log=none
+	localLogger, err := newLocalLogger(logCtx)
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "error creating local logger\n")
+	}
+
+	token, err := getToken(logCtx)
+	if err != nil {
+		f.Close()
+		if localLogger != nil {
+			localLogger.Close()
+		}
+		return err
 	}
 
 	// notify the user if we are using previous configurations.
-	sender := d.checkHashCodeExists(hashCode, logCtx.Config[logzioToken])
+	sender := d.checkHashCodeExists(hashCode, token)
+	if sender == nil {
+		// the queue of a previous run waits for a container with its token when it was set in logzio-token,
+		// the queue of a rotated token is recorded with the hash of the new token
+		configured, _ := getConfiguredToken(logCtx)
+		hashCode = d.takeQueuedHashCode(hashCode, logCtx.Config[logzioDirPath], token, configured)
+	}
+	if sender != nil {
+		if err := checkPreflight(logCtx, sender); err != nil {
+			f.Close()
+			if localLogger != nil {
+				localLogger.Close()
+			}
+			return err
+		}
+	}
 	logzioLogger, err := newLogzioLogger(logCtx, sender, hashCode)
 	if err != nil {
-		return errors.Wrap(err, "error creating logzio logger")
+		f.Close()
+		if localLogger != nil {
+			localLogger.Close()
+		}
+		return fmt.Errorf("error creating logzio logger: %s", maskToken(err.Error(), token))
+	}
+	if sender == nil {
+		if err := checkPreflight(logCtx, logzioLogger.logzioSender); err != nil {
+			// the new sender is not kept, the next container with the token creates it again
+			logzioLogger.Close()
+			d.mu.Lock()
+			delete(d.senders, token)
+			d.mu.Unlock()
+			f.Close()
+			if localLogger != nil {
+				localLogger.Close()
+			}
+			return err
+		}
 	}
 	d.mu.Lock()
-	lf := &ContainerLoggersCtx{logCtx, jsonLogger, *logzioLogger, f}
+	lf := &ContainerLoggersCtx{logCtx, localLogger, logzioLogger, f}
 	d.logs[file] = lf
 	d.idx[logCtx.ContainerID] = lf
 	if sender == nil {
-		d.senders[logCtx.Config[logzioToken]].sender = logzioLogger.logzioSender
-		d.senders[logCtx.Config[logzioToken]].info = logCtx
-		d.senders[logCtx.Config[logzioToken]].hashCode = hashCode
+		d.senders[token].sender = logzioLogger.logzioSender
+		d.senders[token].info = logCtx
+		d.senders[token].hashCode = hashCode
 	}
+	d.saveState()
 	d.mu.Unlock()
 
 	go consumeLog(lf)
@@ -527,67 +715,106 @@ func (d *Driver) StopLogging(file string) error {
 	lf, ok := d.logs[file]
 	if ok {
 		logrus.Info(fmt.Sprintf("%s: Stopping logging Driver for closed container %s.", driverName, lf.info.ContainerID))
+		// consumeLog sends what is left of the stream and closes the local copy
 		lf.stream.Close()
-		lf.jsonLogger.Close()
 		delete(d.logs, file)
+		d.saveState()
 	}
 	d.mu.Unlock()
 	return nil
 }
 
+// consumeLog logs the entries of the container. The partial buffers are owned by this goroutine:
+// readEntries hands it the entries of the FIFO, and the timer the expiry of the oldest buffer.
 func consumeLog(lf *ContainerLoggersCtx) {
-	dec := protoio.NewUint32DelimitedReader(lf.stream, binary.BigEndian, 1e6)
-	defer dec.Close()
 	defer func() {
 		lf.stream.Close()
-		lf.jsonLogger.Close()
+		if lf.localLogger != nil {
+			lf.localLogger.Close()
+		}
 	}()
-	pBuf := &PartialBuffer{
-		startTime: time.Now(),
-		timeout:   lf.logzioLogger.partialBufTimeout,
-		maxBytes:  lf.logzioLogger.maxMsgBufferSize,
-	}
-	lf.logzioLogger.pBuf = pBuf
-	var buf logdriver.LogEntry
+	entries := make(chan logEntry)
+	go readEntries(lf, entries)
+
+	partials := newReassembler(lf.logzioLogger.maxMsgBufferSize, lf.logzioLogger.oversize == oversizeSplit,
+		lf.logzioLogger.partialBufTimeout)
+	flush := time.NewTimer(lf.logzioLogger.partialBufTimeout)
+	stopTimer(flush)
+	defer flush.Stop()
 	for {
-		if err := dec.ReadMsg(&buf); err != nil {
-			if err == io.EOF || err == os.ErrClosed || strings.Contains(err.Error(), "file already closed") {
-				if len(pBuf.buf) != 0 {
-					logrus.WithField("id", lf.info.ContainerID).WithError(err).
-						Warningf("Could not finish sending partial message before closing: %s\n", string(pBuf.buf))
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				// the container stopped in the middle of a message, what was received is sent
+				for _, msg := range partials.expire(time.Now(), true) {
+					lf.logMessage(msg)
 				}
-				logrus.WithField("id", lf.info.ContainerID).WithError(err).Debug("shutting down log logger")
+				logrus.WithField("id", lf.info.ContainerID).Debug("shutting down log logger")
 				return
 			}
-			dec = protoio.NewUint32DelimitedReader(lf.stream, binary.BigEndian, 1e6)
+			if len(bytes.Trim(entry.Line, "\x00")) == 0 && entry.PartialLogMetadata == nil {
+				continue
+			}
+			for _, msg := range partials.add(&entry) {
+				lf.logMessage(msg)
+			}
+		case now := <-flush.C:
+			// the rest of the message didn't come in time, what was received is sent
+			for _, msg := range partials.expire(now, false) {
+				lf.logMessage(msg)
+			}
 		}
-		tBuf := bytes.Trim(buf.Line, "\x00")
-		if len(tBuf) != 0 {
-			pBuf.Add(buf)
-			delta := time.Now().Sub(pBuf.startTime)
-			if !buf.Partial || delta > pBuf.timeout {
-				var msg logger.Message
-				msg.Line = pBuf.buf
-				msg.Source = buf.Source
-				msg.Timestamp = time.Unix(0, buf.TimeNano)
-				msg.Partial = buf.Partial
-
-				if err := lf.logzioLogger.Log(&msg); err != nil {
-					logrus.WithField("id", lf.info.ContainerID).WithError(err).WithField("message", msg).
-						Error("Logz.io logger:error writing log message")
-				}
-				if err := lf.jsonLogger.Log(&msg); err != nil {
-					logrus.WithField("id", lf.info.ContainerID).WithError(err).WithField("message", msg).
-						Error("json logger: error writing log message")
-				}
-				pBuf.Reset()
+		stopTimer(flush)
+		if deadline, ok := partials.deadline(); ok {
+			flush.Reset(time.Until(deadline))
+		}
+	}
+}
+
+// stopTimer stops t and drops a flush it already delivered, so it can be Reset
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// readEntries decodes the entries of the FIFO until it is closed, and then closes entries
+func readEntries(lf *ContainerLoggersCtx, entries chan<- logEntry) {
+	defer close(entries)
+	dec := protoio.NewUint32DelimitedReader(lf.stream, binary.BigEndian, 1e6)
+	defer dec.Close()
+	for {
+		var entry logEntry
+		if err := dec.ReadMsg(&entry); err != nil {
+			if err == io.EOF || err == os.ErrClosed || err == io.ErrClosedPipe || strings.Contains(err.Error(), "file already closed") {
+				logrus.WithField("id", lf.info.ContainerID).WithError(err).Debug("log stream closed")
+				return
 			}
+			dec = protoio.NewUint32DelimitedReader(lf.stream, binary.BigEndian, 1e6)
+			continue
+		}
+		entries <- entry
+	}
+}
+
+// logMessage writes msg to the logz.io logger and to the local copy
+func (lf *ContainerLoggersCtx) logMessage(msg *logger.Message) {
+	if err := lf.logzioLogger.Log(msg); err != nil {
+		logrus.WithField("id", lf.info.ContainerID).WithError(err).WithField("message", msg).
+			Error("Logz.io logger:error writing log message")
+	}
+	if lf.localLogger != nil {
+		if err := lf.localLogger.Log(msg); err != nil {
+			logrus.WithField("id", lf.info.ContainerID).WithError(err).WithField("message", msg).
+				Error("local logger: error writing log message")
 		}
-		buf.Reset()
 	}
 }
 
-func (d *Driver) ReadLogs(info logger.Info, config logger.ReadConfig) (io.ReadCloser, error) {
+func (d *Driver) ReadLogs(info logger.Info, config ReadConfig) (io.ReadCloser, error) {
 	d.mu.Lock()
 	lf, exists := d.idx[info.ContainerID]
 	d.mu.Unlock()
@@ -595,19 +822,30 @@ func (d *Driver) ReadLogs(info logger.Info, config logger.ReadConfig) (io.ReadCl
 		return nil, fmt.Errorf("logger does not exist for %s\n", info.ContainerID)
 	}
 
-	r, w := io.Pipe()
-	lr, ok := lf.jsonLogger.(logger.LogReader)
+	if lf.localLogger == nil {
+		return nil, fmt.Errorf("%s is %s for %s, there are no logs to read\n", logzioLocalLog, localLogNone, info.ContainerID)
+	}
+	lr, ok := lf.localLogger.(logger.LogReader)
 	if !ok {
 		return nil, fmt.Errorf("logger does not support reading\n")
 	}
 
+	r, w := io.Pipe()
 	go func() {
-		watcher := lr.ReadLogs(config)
+		watcher := lr.ReadLogs(config.ReadConfig)
 
 		enc := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
 		defer enc.Close()
 		defer watcher.Close()
 
+		// a follow stops at until, even when the container logs nothing after it
+		var untilTimer <-chan time.Time
+		if !config.Until.IsZero() && config.Follow {
+			timer := time.NewTimer(config.Until.Sub(time.Now()))
+			defer timer.Stop()
+			untilTimer = timer.C
+		}
+
 		var buf logdriver.LogEntry
 		for {
 			select {
@@ -616,6 +854,11 @@ func (d *Driver) ReadLogs(info logger.Info, config logger.ReadConfig) (io.ReadCl
 					w.Close()
 					return
 				}
+				// the entries are read in order, nothing after until is sent
+				if !config.Until.IsZero() && msg.Timestamp.After(config.Until) {
+					w.Close()
+					return
+				}
 
 				buf.Line = msg.Line
 				buf.Partial = msg.Partial
@@ -629,6 +872,9 @@ func (d *Driver) ReadLogs(info logger.Info, config logger.ReadConfig) (io.ReadCl
 			case err := <-watcher.Err:
 				w.CloseWithError(err)
 				return
+			case <-untilTimer:
+				w.Close()
+				return
 			}
 
 			buf.Reset()
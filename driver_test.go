@@ -6,6 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -23,7 +27,7 @@ func TestValidateDriverOpt(t *testing.T) {
 		logzioTag:       "logzioTag",
 		logzioToken:     "logzioToken",
 		logzioType:      "logzioType",
-		logzioURL:       "logzioURL",
+		logzioURL:       "https://listener.logz.io:8071",
 		logzioDirPath:   fmt.Sprintf("./%s", t.Name()),
 		logzioLogAttr:   `{"num":6.13,"str":"str"}`,
 		envRegex:        "reg",
@@ -42,7 +46,7 @@ func TestValidateDriverOpt(t *testing.T) {
 
 func TestMissingToken(t *testing.T) {
 	conf := map[string]string{
-		logzioURL:     "logzioURL",
+		logzioURL:     "https://listener.logz.io:8071",
 		logzioDirPath: fmt.Sprintf("./%s", t.Name()),
 	}
 
@@ -63,7 +67,7 @@ func TestNoSuchLogOpt(t *testing.T) {
 		logzioTag:       "logzioTag",
 		logzioToken:     "logzioToken",
 		logzioType:      "logzioType",
-		logzioURL:       "logzioURL",
+		logzioURL:       "https://listener.logz.io:8071",
 		logzioDirPath:   fmt.Sprintf("./%s", t.Name()),
 		"logzioDummy":   "logzioDummy",
 	}
@@ -218,19 +222,13 @@ func TestSendingJson(t *testing.T) {
 	}
 }
 
-func TestStress(t *testing.T) {
-	mock := NewtestHTTPMock(t, []int{http.StatusOK})
-	mock.setStatusCode(http.StatusOK)
-	go mock.Serve()
-	defer mock.Close()
-	os.Setenv(envLogsDrainTimeout, "1s")
-	defer os.Setenv(envLogsDrainTimeout, "5s")
-	info := logger.Info{
+func stressInfo(url string, token string, format string, dir string) logger.Info {
+	return logger.Info{
 		Config: map[string]string{
-			logzioURL:     mock.URL(),
-			logzioToken:   mock.Token(),
-			logzioFormat:  defaultFormat,
-			logzioDirPath: fmt.Sprintf("./%s", t.Name()),
+			logzioURL:     url,
+			logzioToken:   token,
+			logzioFormat:  format,
+			logzioDirPath: dir,
 			logzioLogAttr: `{"num":6.13,"str":"str"}`,
 			logzioTag:     "{{.ImageName}}",
 			dockerLabels:  "labelKey",
@@ -245,6 +243,16 @@ func TestStress(t *testing.T) {
 			"labelKey": "labelValue",
 		},
 	}
+}
+
+func TestStress(t *testing.T) {
+	mock := NewtestHTTPMock(t, []int{http.StatusOK})
+	mock.setStatusCode(http.StatusOK)
+	go mock.Serve()
+	defer mock.Close()
+	os.Setenv(envLogsDrainTimeout, "1s")
+	defer os.Setenv(envLogsDrainTimeout, "5s")
+	info := stressInfo(mock.URL(), mock.Token(), defaultFormat, fmt.Sprintf("./%s", t.Name()))
 	totalLogs := 10000
 	logziol, err := newLogzioLogger(info, nil, "0")
 	if err != nil {
@@ -294,6 +302,46 @@ func TestStress(t *testing.T) {
 
 }
 
+// BenchmarkStress logs the lines of TestStress until they are in the disk queue, encoded in the
+// logger's goroutine and by a pool of workers
+func BenchmarkStress(b *testing.B) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	os.Setenv(envLogsDrainTimeout, "1h")
+	defer os.Setenv(envLogsDrainTimeout, "5s")
+	lines := map[string]string{
+		defaultFormat: "request completed in 35ms with status 200 for GET /api/v1/items?page=%d",
+		jsonFormat:    `{"level":"info","msg":"request completed","duration_ms":35,"status":200,"page":%d}`,
+	}
+	for _, format := range []string{defaultFormat, jsonFormat} {
+		for _, workers := range []int{0, 4} {
+			b.Run(fmt.Sprintf("%s/workers-%d", format, workers), func(b *testing.B) {
+				info := stressInfo(ts.URL, "123456789", format, fmt.Sprintf("./%s", b.Name()))
+				defer os.RemoveAll(info.Config[logzioDirPath])
+				logziol, err := newLogzioLogger(info, nil, "0")
+				if err != nil {
+					b.Fatal(err)
+				}
+				logziol.encoders = newEncodePool(workers)
+				defer logziol.encoders.stop()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := logziol.Log(&logger.Message{Line: []byte(fmt.Sprintf(lines[format], i)), Source: "stdout",
+						Timestamp: time.Now()}); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for logziol.logzioSender.Stats().QueueLength < uint64(b.N) {
+					time.Sleep(time.Millisecond)
+				}
+				b.StopTimer()
+				logziol.Close()
+			})
+		}
+	}
+}
+
 func TestSendingEmptyString(t *testing.T) {
 	mock := NewtestHTTPMock(t, []int{http.StatusOK, http.StatusOK})
 	go mock.Serve()
@@ -645,3 +693,171 @@ func TestServerIsDown(t *testing.T) {
 		}
 	}
 }
+
+func TestServerIsDownRetrySchedule(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	var sleeps []time.Duration
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+	retrySleep = func(d time.Duration) {
+		mu.Lock()
+		sleeps = append(sleeps, d)
+		mu.Unlock()
+	}
+	defer func() { retrySleep = nil }()
+	info := logger.Info{
+		Config: map[string]string{
+			logzioURL:                 ts.URL,
+			logzioToken:               "123456789",
+			logzioFormat:              jsonFormat,
+			logzioDirPath:             fmt.Sprintf("./%s", t.Name()),
+			logzioRetryInitialBackoff: "200ms",
+			logzioRetryMultiplier:     "2",
+			logzioRetryMaxBackoff:     "500ms",
+			logzioRetryMaxAttempts:    "4",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+	if err := os.Setenv(envLogsDrainTimeout, "60s"); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv(envLogsDrainTimeout, "5s")
+
+	logziol, err := newLogzioLogger(info, nil, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(info.Config[logzioDirPath])
+
+	if err := logziol.Log(&logger.Message{Line: []byte(t.Name()), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Failed Log string: %s", err)
+	}
+	if err := logziol.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []time.Duration{200 * time.Millisecond, 400 * time.Millisecond, 500 * time.Millisecond}
+	if attempts != len(expected)+1 {
+		t.Fatalf("Unexpected number of attempts %d, expected %d", attempts, len(expected)+1)
+	}
+	if !reflect.DeepEqual(sleeps, expected) {
+		t.Fatalf("Unexpected backoff schedule %v, expected %v", sleeps, expected)
+	}
+
+	// the batch reached max attempts, so it is not kept on disk
+	q, err := goque.OpenQueue(fmt.Sprintf("./%s/0", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Length() != 0 {
+		t.Fatalf("Queue length is not as expected: %d", q.Length())
+	}
+}
+
+func TestRejectedBatchIsNotRetried(t *testing.T) {
+	mock := NewtestHTTPMock(t, []int{http.StatusUnauthorized})
+	go mock.Serve()
+	defer mock.Close()
+	info := logger.Info{
+		Config: map[string]string{
+			logzioURL:     mock.URL(),
+			logzioToken:   mock.Token(),
+			logzioFormat:  jsonFormat,
+			logzioDirPath: fmt.Sprintf("./%s", t.Name()),
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+	logziol, err := newLogzioLogger(info, nil, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(info.Config[logzioDirPath])
+
+	if err := logziol.Log(&logger.Message{Line: []byte(t.Name()), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Failed Log string: %s", err)
+	}
+	if err := logziol.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if batchNumber := mock.Batch(); batchNumber != 1 {
+		t.Fatalf("Unexpected batch number %d. Expected a single attempt", batchNumber)
+	}
+}
+
+func TestInvalidRetryPolicy(t *testing.T) {
+	for opt, value := range map[string]string{
+		logzioRetryInitialBackoff: "soon",
+		logzioRetryMultiplier:     "0.5",
+		logzioRetryJitter:         "2",
+		logzioRetryMaxAttempts:    "-1",
+	} {
+		conf := map[string]string{
+			logzioToken:   "logzioToken",
+			logzioDirPath: fmt.Sprintf("./%s", t.Name()),
+			opt:           value,
+		}
+		if _, err := validateDriverOpt(logger.Info{ContainerID: "123456789", Config: conf}); err == nil {
+			t.Fatalf("Expected an error for %s=%s", opt, value)
+		}
+	}
+}
+
+func TestStartLoggingClosesFifoOnError(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "fifo")
+	writer := openTestFifo(t, file)
+	info := logger.Info{
+		Config:      map[string]string{logzioDirPath: dir},
+		ContainerID: "containeriid",
+		LogPath:     filepath.Join(dir, "container.log"),
+	}
+	d := newDriver()
+	if err := d.StartLogging(file, info); err == nil {
+		t.Fatal("Expected an error for the missing token")
+	}
+	w := <-writer
+	if w == nil {
+		t.FailNow()
+	}
+	defer w.Close()
+	// writing fails once the reader is closed
+	if _, err := w.Write([]byte("log")); err == nil {
+		t.Fatal("The fifo is still open after StartLogging failed")
+	}
+}
+
+// openTestFifo opens the writer side of the fifo at path like the daemon does,
+// the open returns once StartLogging opens the reader side
+func openTestFifo(t *testing.T, path string) chan *os.File {
+	if err := syscall.Mkfifo(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	writer := make(chan *os.File, 1)
+	go func() {
+		w, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		writer <- w
+	}()
+	return writer
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	//log-opt
+	logzioDryRun     = "logzio-dry-run"
+	logzioDryRunFile = "logzio-dry-run-file"
+
+	envDryRun     = "LOGZIO_DRY_RUN"
+	envDryRunFile = "LOGZIO_DRY_RUN_FILE"
+)
+
+// getDryRun returns whether the documents of the container are written to the dry-run file instead of
+// being sent, and the path of the file, empty for the plugin's stderr
+func getDryRun(loggerInfo logger.Info) (bool, string, error) {
+	dryRun := false
+	if str := getOptOrEnv(loggerInfo, logzioDryRun, envDryRun); str != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(str); err != nil {
+			return false, "", fmt.Errorf("%s must be true or false: %s\n", logzioDryRun, str)
+		}
+	}
+	return dryRun, getOptOrEnv(loggerInfo, logzioDryRunFile, envDryRunFile), nil
+}
+
+// dryRunWriters are shared by the containers writing to the same file, so their lines don't interleave
+var dryRunWriters = struct {
+	sync.Mutex
+	byPath map[string]*dryRunWriter
+}{byPath: make(map[string]*dryRunWriter)}
+
+// dryRunWriter writes one JSON line for every document a logger would have sent
+type dryRunWriter struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	w    io.Writer
+}
+
+// dryRunRecord is a line of the dry-run file. Output is the config file output a route sent the
+// document to, it is empty for the container's own sender.
+type dryRunRecord struct {
+	ContainerID string          `json:"container_id"`
+	Output      string          `json:"output,omitempty"`
+	Document    json.RawMessage `json:"document"`
+}
+
+// openDryRun returns the writer of path, the files are opened for appending and stay open
+func openDryRun(path string) (*dryRunWriter, error) {
+	dryRunWriters.Lock()
+	defer dryRunWriters.Unlock()
+	if w, ok := dryRunWriters.byPath[path]; ok {
+		return w, nil
+	}
+	w := &dryRunWriter{path: path, w: os.Stderr}
+	if err := w.reopen(); err != nil {
+		return nil, err
+	}
+	dryRunWriters.byPath[path] = w
+	return w, nil
+}
+
+// reopen opens the file again when it was removed or rotated since it was opened
+func (d *dryRunWriter) reopen() error {
+	if d.path == "" {
+		return nil
+	}
+	if d.file != nil {
+		current, err := os.Stat(d.path)
+		opened, openedErr := d.file.Stat()
+		if err == nil && openedErr == nil && os.SameFile(current, opened) {
+			return nil
+		}
+		d.file.Close()
+	}
+	f, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s\n", logzioDryRunFile, err)
+	}
+	d.file, d.w = f, f
+	return nil
+}
+
+func (d *dryRunWriter) write(containerID string, output string, data []byte) error {
+	line, err := json.Marshal(dryRunRecord{ContainerID: containerID, Output: output, Document: data})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.reopen(); err != nil {
+		return err
+	}
+	_, err = d.w.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func TestDryRun(t *testing.T) {
+	dir, err := filepath.Abs(fmt.Sprintf("./%s", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener := newRecordingListener()
+	defer listener.Close()
+
+	configFile := writeTestFile(t, dir, "config.json", []byte(fmt.Sprintf(`{
+		"filters": [{"match": "healthcheck"}],
+		"redact": [{"match": "secret"}],
+		"routes": [{"match": "audit", "output": "audit"}],
+		"outputs": {"audit": {"logzio-url": %q, "logzio-token": "auditToken", "logzio-dir-path": %q}}
+	}`, listener.URL, dir)))
+	if err := pluginConfigs.load(configFile); err != nil {
+		t.Fatal(err)
+	}
+	defer pluginConfigs.load("")
+
+	dryRunFile := filepath.Join(dir, "dry-run.json")
+	info := logger.Info{
+		Config: map[string]string{
+			logzioURL:        listener.URL,
+			logzioToken:      "123456789",
+			logzioDirPath:    dir,
+			logzioFormat:     jsonFormat,
+			logzioLogAttr:    `{"env":"test"}`,
+			logzioDryRun:     "true",
+			logzioDryRunFile: dryRunFile,
+		},
+		ContainerID: "containeriid",
+	}
+	hashCode, err := validateDriverOpt(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logziol, err := newLogzioLogger(info, nil, hashCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{`{"msg":"the secret is out"}`, "healthcheck ok", "audit trail"} {
+		if err := logziol.Log(&logger.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := logziol.Close(); err != nil {
+		t.Fatal(err)
+	}
+	pluginConfigs.outputs["audit"].sender.Drain()
+
+	data, err := ioutil.ReadFile(dryRunFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected two documents:\n%s", data)
+	}
+	// the routed document is written when it is logged, the others once the channel delivers them
+	var routed, own dryRunRecord
+	for _, line := range lines {
+		var record dryRunRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Output != "" {
+			routed = record
+		} else {
+			own = record
+		}
+	}
+	if routed.Output != "audit" || !strings.Contains(string(routed.Document), "audit trail") {
+		t.Fatalf("Unexpected routed document: %+v", routed)
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(own.Document, &doc); err != nil {
+		t.Fatal(err)
+	}
+	message, _ := doc["message"].(map[string]interface{})
+	if own.ContainerID != "containeriid" || doc["env"] != "test" ||
+		message["msg"] != "the [REDACTED] is out" || doc["logzio_codec"] != "json" {
+		t.Fatalf("Unexpected document: %s", own.Document)
+	}
+	if messages := listener.Messages(); messages != "" {
+		t.Fatalf("Dry run sent documents: %s", messages)
+	}
+}
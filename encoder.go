@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	envEncodeWorkers = "LOGZIO_ENCODE_WORKERS"
+
+	defaultEncodeWorkers = 0
+	// encodeBatchSize is the most documents a logger takes from its channel to encode together
+	encodeBatchSize = 256
+	// minParallelBatch is the smallest batch that is split between the workers
+	minParallelBatch = 32
+	// maxPooledBuffer keeps the buffers of big messages out of the pool
+	maxPooledBuffer = 64 * 1024
+)
+
+// logDocument is a line on its way to the sender. The fields every document of the container has
+// are added by its docEncoder.
+type logDocument struct {
+	timestamp time.Time
+	source    string
+	line      []byte
+	// partial are the fields of a message the partial buffer cut or split
+	partial map[string]string
+}
+
+// lineFields are written for every document, a static field of the same name is not sent
+var lineFields = map[string]bool{"driver_timestamp": true, "log_source": true, "message": true}
+
+// partialFieldNames are the fields the partial buffer adds to the messages it cut or split
+var partialFieldNames = []string{truncatedField, originalSizeField, groupIDField, chunkField}
+
+// optionalFields are written for some documents, a static field of the same name is sent when the
+// document doesn't have its own
+var optionalFields = append(partialFieldNames[:len(partialFieldNames):len(partialFieldNames)], "logzio_codec")
+
+// docEncoder writes the documents of a logger as JSON. The static fields are encoded once when the
+// logger starts, the fields of the line are streamed after them without building a map.
+type docEncoder struct {
+	static   []byte
+	optional map[string][]byte
+	json     bool
+}
+
+func newDocEncoder(fields map[string]interface{}, format string) (*docEncoder, error) {
+	e := &docEncoder{optional: make(map[string][]byte), json: format != defaultFormat}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var static bytes.Buffer
+	for _, key := range keys {
+		if lineFields[key] {
+			continue
+		}
+		value, err := json.Marshal(fields[key])
+		if err != nil {
+			return nil, err
+		}
+		if isOptionalField(key) {
+			e.optional[key] = value
+			continue
+		}
+		writeJSONString(&static, key)
+		static.WriteByte(':')
+		static.Write(value)
+		static.WriteByte(',')
+	}
+	e.static = static.Bytes()
+	return e, nil
+}
+
+func isOptionalField(key string) bool {
+	for _, field := range optionalFields {
+		if field == key {
+			return true
+		}
+	}
+	return false
+}
+
+// encode appends the JSON document of doc to buf
+func (e *docEncoder) encode(buf *bytes.Buffer, doc *logDocument) {
+	var scratch [64]byte
+	buf.WriteByte('{')
+	buf.Write(e.static)
+	buf.WriteString(`"driver_timestamp":"`)
+	buf.Write(time.Unix(0, doc.timestamp.UnixNano()).AppendFormat(scratch[:0], time.RFC3339Nano))
+	buf.WriteString(`","log_source":`)
+	writeJSONString(buf, doc.source)
+	for _, field := range partialFieldNames {
+		value, ok := doc.partial[field]
+		if !ok {
+			e.writeOptional(buf, field)
+			continue
+		}
+		buf.WriteByte(',')
+		writeJSONString(buf, field)
+		buf.WriteByte(':')
+		switch field {
+		case truncatedField:
+			buf.WriteString(strconv.FormatBool(value == "true"))
+		case originalSizeField, chunkField:
+			n, _ := strconv.Atoi(value)
+			buf.Write(strconv.AppendInt(scratch[:0], int64(n), 10))
+		default:
+			writeJSONString(buf, value)
+		}
+	}
+	buf.WriteString(`,"message":`)
+	// a line that is not valid JSON is sent as a string, compact leaves buf as it was
+	if e.json && json.Compact(buf, doc.line) == nil {
+		buf.WriteString(`,"logzio_codec":"json"`)
+	} else {
+		writeJSONBytes(buf, doc.line)
+		e.writeOptional(buf, "logzio_codec")
+	}
+	buf.WriteByte('}')
+}
+
+func (e *docEncoder) writeOptional(buf *bytes.Buffer, field string) {
+	if value, ok := e.optional[field]; ok {
+		buf.WriteByte(',')
+		writeJSONString(buf, field)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+}
+
+// partialFields copies the fields of attrs the encoder sends, the attrs of a message can be reused
+// once it is logged
+func partialFields(attrs map[string]string) map[string]string {
+	var fields map[string]string
+	for _, field := range partialFieldNames {
+		if value, ok := attrs[field]; ok {
+			if fields == nil {
+				fields = make(map[string]string)
+			}
+			fields[field] = value
+		}
+	}
+	return fields
+}
+
+const hexDigits = "0123456789abcdef"
+
+// writeJSONString writes s as a JSON string, escaped the way encoding/json escapes it
+func writeJSONString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buf.WriteString(s[start:i])
+			switch b {
+			case '"', '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(b)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			default:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hexDigits[b>>4])
+				buf.WriteByte(hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf.WriteString(s[start:i])
+			buf.WriteString(`\ufffd`)
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 end a line in javascript
+		if c == '\u2028' || c == '\u2029' {
+			buf.WriteString(s[start:i])
+			buf.WriteString(`\u202`)
+			buf.WriteByte(hexDigits[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf.WriteString(s[start:])
+	buf.WriteByte('"')
+}
+
+// writeJSONBytes is writeJSONString for a line, without copying it to a string. encoding/json has the
+// same pair.
+func writeJSONBytes(buf *bytes.Buffer, s []byte) {
+	buf.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buf.Write(s[start:i])
+			switch b {
+			case '"', '\\':
+				buf.WriteByte('\\')
+				buf.WriteByte(b)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			default:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hexDigits[b>>4])
+				buf.WriteByte(hexDigits[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRune(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf.Write(s[start:i])
+			buf.WriteString(`\ufffd`)
+			i += size
+			start = i
+			continue
+		}
+		if c == '\u2028' || c == '\u2029' {
+			buf.Write(s[start:i])
+			buf.WriteString(`\u202`)
+			buf.WriteByte(hexDigits[c&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf.Write(s[start:])
+	buf.WriteByte('"')
+}
+
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+func getBuffer() *bytes.Buffer {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+}
+
+// encodePool encodes the batches of the loggers in parallel. Its workers are shared by the
+// containers, a pool without workers encodes in the goroutine of the logger.
+type encodePool struct {
+	workers int
+	jobs    chan encodeJob
+}
+
+type encodeJob struct {
+	encoder *docEncoder
+	docs    []*logDocument
+	bufs    []*bytes.Buffer
+	done    *sync.WaitGroup
+}
+
+var (
+	encodersOnce sync.Once
+	encoders     *encodePool
+)
+
+// sharedEncodePool returns the pool of LOGZIO_ENCODE_WORKERS workers, started by the first logger
+func sharedEncodePool() *encodePool {
+	encodersOnce.Do(func() {
+		encoders = newEncodePool(getEnvInt(envEncodeWorkers, defaultEncodeWorkers))
+	})
+	return encoders
+}
+
+func newEncodePool(workers int) *encodePool {
+	p := &encodePool{workers: workers}
+	if workers > 1 {
+		p.jobs = make(chan encodeJob, workers)
+		for i := 0; i < workers; i++ {
+			go p.work()
+		}
+	}
+	return p
+}
+
+func (p *encodePool) work() {
+	for job := range p.jobs {
+		encodeAll(job.encoder, job.docs, job.bufs)
+		job.done.Done()
+	}
+}
+
+// stop ends the workers, the pool can't be used afterwards
+func (p *encodePool) stop() {
+	if p.jobs != nil {
+		close(p.jobs)
+	}
+}
+
+// encode fills bufs with the documents of docs, in the same order
+func (p *encodePool) encode(e *docEncoder, docs []*logDocument, bufs []*bytes.Buffer) {
+	if p == nil || p.workers <= 1 || len(docs) < minParallelBatch {
+		encodeAll(e, docs, bufs)
+		return
+	}
+	chunk := (len(docs) + p.workers - 1) / p.workers
+	var done sync.WaitGroup
+	for start := 0; start < len(docs); start += chunk {
+		end := start + chunk
+		if end > len(docs) {
+			end = len(docs)
+		}
+		done.Add(1)
+		p.jobs <- encodeJob{encoder: e, docs: docs[start:end], bufs: bufs[start:end], done: &done}
+	}
+	done.Wait()
+}
+
+func encodeAll(e *docEncoder, docs []*logDocument, bufs []*bytes.Buffer) {
+	for i, doc := range docs {
+		e.encode(bufs[i], doc)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var encoderTestFields = map[string]interface{}{
+	"hostname":     "host",
+	"type":         defaultSourceType,
+	"tags":         "containeriid",
+	"log_source":   "opt-source",
+	"num":          6.13,
+	"str":          "<str>",
+	"nested":       map[string]interface{}{"a": []interface{}{1.0, "b"}},
+	"logzio_codec": "static",
+	"chunk":        "static",
+}
+
+// encodeMap builds the document the way the logger did before the encoder, copying the static
+// fields to a map per line
+func encodeMap(fields map[string]interface{}, format string, doc *logDocument) ([]byte, error) {
+	logMessage := make(map[string]interface{})
+	for index, element := range fields {
+		logMessage[index] = element
+	}
+	logMessage["driver_timestamp"] = time.Unix(0, doc.timestamp.UnixNano()).Format(time.RFC3339Nano)
+	logMessage["log_source"] = doc.source
+	for field, value := range doc.partial {
+		switch field {
+		case truncatedField:
+			logMessage[field] = value == "true"
+		case originalSizeField, chunkField:
+			n, _ := strconv.Atoi(value)
+			logMessage[field] = n
+		default:
+			logMessage[field] = value
+		}
+	}
+	var jsonLogLine json.RawMessage
+	if format != defaultFormat && json.Unmarshal(doc.line, &jsonLogLine) == nil {
+		logMessage["message"] = &jsonLogLine
+		logMessage["logzio_codec"] = "json"
+	} else {
+		logMessage["message"] = string(doc.line)
+	}
+	return json.Marshal(logMessage)
+}
+
+func TestDocEncoder(t *testing.T) {
+	lines := []string{
+		"plain line",
+		"quotes \" and \\ backslash\ttab\r\n",
+		"html <b>&amp;</b>",
+		"control \x00\x01\x1f\x7f",
+		"unicode ünïcødé 日本    😀",
+		"invalid \xff\xfe utf8 \xe2\x28\xa1",
+		`{"json": {"nested": [1, 2.5, "three"]}, "html": "<a>"}`,
+		`  [1, 2, 3]  `,
+		`{"broken": `,
+		`123`,
+	}
+	partials := []map[string]string{
+		nil,
+		{truncatedField: "true", originalSizeField: "2048"},
+		{groupIDField: "0123abcd", chunkField: "2", originalSizeField: "4096"},
+	}
+	for _, format := range []string{defaultFormat, jsonFormat} {
+		encoder, err := newDocEncoder(encoderTestFields, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range lines {
+			for _, partial := range partials {
+				doc := &logDocument{timestamp: time.Now(), source: "stderr", line: []byte(line), partial: partial}
+				var buf bytes.Buffer
+				encoder.encode(&buf, doc)
+				expected, err := encodeMap(encoderTestFields, format, doc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got, want map[string]interface{}
+				if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+					t.Fatalf("%s %q: invalid document %s: %s", format, line, buf.Bytes(), err)
+				}
+				json.Unmarshal(expected, &want)
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s %q: unexpected document\n%s\nexpected\n%s", format, line, buf.Bytes(), expected)
+				}
+			}
+		}
+	}
+}
+
+func TestWriteJSONString(t *testing.T) {
+	for _, s := range []string{"", "ascii", "\"\\/\b\f\n\r\t", "<>&", "\x00\x1f", "é  \U0001F600", "\xff\xc3\x28", "end\xe2\x82"} {
+		expected, _ := json.Marshal(s)
+		var str, b bytes.Buffer
+		writeJSONString(&str, s)
+		writeJSONBytes(&b, []byte(s))
+		// newer go versions write \b and \f instead of \u0008 and \u000c, so the strings are compared
+		var got, want string
+		json.Unmarshal(expected, &want)
+		if err := json.Unmarshal(str.Bytes(), &got); err != nil || got != want {
+			t.Fatalf("%q: expected %s, got %s", s, expected, str.Bytes())
+		}
+		if b.String() != str.String() {
+			t.Fatalf("%q: expected the same encoding for bytes, got %s and %s", s, str.Bytes(), b.Bytes())
+		}
+	}
+}
+
+func TestEncodePoolOrder(t *testing.T) {
+	pool := newEncodePool(4)
+	defer pool.stop()
+	encoder, err := newDocEncoder(map[string]interface{}{"hostname": "host"}, defaultFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := make([]*logDocument, encodeBatchSize-1)
+	bufs := make([]*bytes.Buffer, len(docs))
+	for i := range docs {
+		docs[i] = &logDocument{timestamp: time.Now(), source: "stdout", line: []byte(fmt.Sprintf("line %d", i))}
+		bufs[i] = getBuffer()
+	}
+	pool.encode(encoder, docs, bufs)
+	for i, buf := range bufs {
+		var doc map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc["message"] != fmt.Sprintf("line %d", i) {
+			t.Fatalf("Expected line %d, got %v", i, doc["message"])
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for _, format := range []string{defaultFormat, jsonFormat} {
+		line := []byte(`request completed in 35ms with status 200 for GET /api/v1/items?page=2 from 10.0.0.12`)
+		if format == jsonFormat {
+			line = []byte(`{"level":"info","msg":"request completed","duration_ms":35,"status":200,"path":"/api/v1/items?page=2"}`)
+		}
+		doc := &logDocument{timestamp: time.Now(), source: "stdout", line: line}
+		b.Run(format+"/map", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := encodeMap(encoderTestFields, format, doc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(format+"/encoder", func(b *testing.B) {
+			encoder, err := newDocEncoder(encoderTestFields, format)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf := getBuffer()
+				encoder.encode(buf, doc)
+				putBuffer(buf)
+			}
+		})
+	}
+}
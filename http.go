@@ -5,6 +5,8 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/docker/docker/daemon/logger"
 	"github.com/docker/docker/pkg/ioutils"
@@ -25,9 +27,16 @@ type CapabilitiesResponse struct {
 	Cap logger.Capability
 }
 
+// ReadConfig is the read config of docker logs. Until is not in the ReadConfig of
+// every docker version, it is used when the request has it.
+type ReadConfig struct {
+	logger.ReadConfig
+	Until time.Time
+}
+
 type ReadLogsRequest struct {
 	Info   logger.Info
-	Config logger.ReadConfig
+	Config ReadConfig
 }
 
 func handlers(h *sdk.Handler, d *Driver) {
@@ -57,10 +66,15 @@ func handlers(h *sdk.Handler, d *Driver) {
 
 	h.HandleFunc("/LogDriver.Capabilities", func(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(&CapabilitiesResponse{
-			Cap: logger.Capability{ReadLogs: true},
+			// docker logs is served from the local copy, unless the plugin keeps none
+			Cap: logger.Capability{ReadLogs: os.Getenv(envLocalLog) != localLogNone},
 		})
 	})
 
+	h.HandleFunc("/Logzio.Status", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&StatusResponse{Senders: d.Status()})
+	})
+
 	h.HandleFunc("/LogDriver.ReadLogs", func(w http.ResponseWriter, r *http.Request) {
 		var req ReadLogsRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
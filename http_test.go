@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/go-plugins-helpers/sdk"
+	protoio "github.com/gogo/protobuf/io"
+)
+
+// readLogsRequest posts a ReadLogs request to the handlers and decodes the framed entries of the response
+func readLogsRequest(t *testing.T, addr string, req ReadLogsRequest) ([]logdriver.LogEntry, int) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post("http://"+addr+"/LogDriver.ReadLogs", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+	dec := protoio.NewUint32DelimitedReader(resp.Body, binary.BigEndian, 1e6)
+	var entries []logdriver.LogEntry
+	for {
+		var entry logdriver.LogEntry
+		if err := dec.ReadMsg(&entry); err != nil {
+			if err == io.EOF {
+				return entries, resp.StatusCode
+			}
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func entryLines(entries []logdriver.LogEntry) string {
+	var lines []string
+	for _, entry := range entries {
+		// the local copies keep the newline of every complete line
+		lines = append(lines, strings.TrimSuffix(string(entry.Line), "\n"))
+	}
+	return strings.Join(lines, ",")
+}
+
+func TestReadLogsHandler(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := &Driver{idx: make(map[string]*ContainerLoggersCtx)}
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, mode := range []string{localLogJSON, localLogLocal, localLogNone} {
+		info := logger.Info{
+			Config:      map[string]string{logzioLocalLog: mode},
+			ContainerID: mode,
+			LogPath:     filepath.Join(dir, mode+".log"),
+		}
+		localLogger, err := newLocalLogger(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if localLogger != nil {
+			defer localLogger.Close()
+			for i := 0; i < 5; i++ {
+				msg := &logger.Message{Line: []byte(fmt.Sprintf("line %d", i)), Source: "stdout",
+					Timestamp: base.Add(time.Duration(i) * time.Second)}
+				if err := localLogger.Log(msg); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		d.idx[mode] = &ContainerLoggersCtx{info: info, localLogger: localLogger}
+	}
+
+	h := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
+	handlers(&h, d)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go h.Serve(l)
+	addr := l.Addr().String()
+
+	for _, c := range []struct {
+		container string
+		config    ReadConfig
+		expected  string
+	}{
+		{localLogJSON, ReadConfig{ReadConfig: logger.ReadConfig{Tail: -1}}, "line 0,line 1,line 2,line 3,line 4"},
+		{localLogJSON, ReadConfig{ReadConfig: logger.ReadConfig{Tail: 2}}, "line 3,line 4"},
+		{localLogLocal, ReadConfig{ReadConfig: logger.ReadConfig{Tail: -1, Since: base.Add(2 * time.Second)},
+			Until: base.Add(3 * time.Second)}, "line 2,line 3"},
+		{localLogLocal, ReadConfig{ReadConfig: logger.ReadConfig{Tail: 1}}, "line 4"},
+	} {
+		entries, status := readLogsRequest(t, addr, ReadLogsRequest{Info: logger.Info{ContainerID: c.container}, Config: c.config})
+		if status != http.StatusOK {
+			t.Fatalf("Unexpected status %d for %s %+v", status, c.container, c.config)
+		}
+		if lines := entryLines(entries); lines != c.expected {
+			t.Errorf("Expected %q for %s %+v, got %q", c.expected, c.container, c.config, lines)
+		}
+		for _, entry := range entries {
+			if entry.Source != "stdout" || entry.TimeNano < base.UnixNano() {
+				t.Errorf("Unexpected entry: %+v", entry)
+			}
+		}
+	}
+
+	// a follow streams the new entries and ends at until
+	for _, mode := range []string{localLogJSON, localLogLocal} {
+		go func(localLogger logger.Logger) {
+			time.Sleep(300 * time.Millisecond)
+			localLogger.Log(&logger.Message{Line: []byte("followed"), Source: "stderr", Timestamp: time.Now()})
+		}(d.idx[mode].localLogger)
+		start := time.Now()
+		entries, _ := readLogsRequest(t, addr, ReadLogsRequest{
+			Info:   logger.Info{ContainerID: mode},
+			Config: ReadConfig{ReadConfig: logger.ReadConfig{Tail: 1, Follow: true}, Until: time.Now().Add(time.Second)},
+		})
+		if lines := entryLines(entries); lines != "line 4,followed" {
+			t.Errorf("Expected the tail and the followed line for %s, got %q", mode, lines)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("Follow of %s did not stop at until: %s", mode, elapsed)
+		}
+	}
+
+	if _, status := readLogsRequest(t, addr, ReadLogsRequest{Info: logger.Info{ContainerID: localLogNone}}); status != http.StatusInternalServerError {
+		t.Errorf("Expected reading without a local copy to fail, got %d", status)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/logzio/logzio-logging-plugin/listenersim"
+)
+
+// listenerSimCommand serves the listener simulator for local integration testing, e.g.
+// logzio-logging-plugin listener-sim --addr 127.0.0.1:8071 --tokens <token> --script 500,reset,ok --loop
+// It prints the documents it accepts, and what it received when it stops.
+func listenerSimCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("listener-sim", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:8071", "address to listen on, the url of the containers is http://<addr>")
+	tokens := flags.String("tokens", "", "comma separated tokens to accept, any token when empty")
+	maxBodySize := flags.String("max-body-size", "", "answer bigger bulks with 413, e.g. 10m, no limit when empty")
+	status := flags.Int("status", 200, "status of the accepted bulks")
+	latency := flags.Duration("latency", 0, "wait before every answer")
+	script := flags.String("script", "", "faults of the requests in order: a status code, ok, reset or partial=<bytes>, "+
+		"with an optional +<latency>, e.g. 500+2s,reset,partial=1024,ok")
+	loop := flags.Bool("loop", false, "start the script over when it ends")
+	duration := flags.Duration("duration", 0, "stop after this long, 0 serves until interrupted")
+	quiet := flags.Bool("quiet", false, "don't print the documents")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config := listenersim.Config{Status: *status, Latency: *latency, Loop: *loop}
+	for _, token := range strings.Split(*tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			config.Tokens = append(config.Tokens, token)
+		}
+	}
+	if *maxBodySize != "" {
+		size, err := units.FromHumanSize(*maxBodySize)
+		if err != nil || size < 1 {
+			return fmt.Errorf("--max-body-size is not a valid size, e.g. 10m or 1g: %s", *maxBodySize)
+		}
+		config.MaxBodySize = size
+	}
+	faults, err := listenersim.ParseScript(*script)
+	if err != nil {
+		return err
+	}
+	config.Script = faults
+
+	sim := listenersim.New(config)
+	var documents int
+	var mu sync.Mutex
+	sim.OnDocument(func(doc listenersim.Document) {
+		mu.Lock()
+		defer mu.Unlock()
+		documents++
+		if !*quiet {
+			fmt.Fprintf(out, "%s\n", doc.Raw)
+		}
+	})
+	if err := sim.Listen(*addr); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "listener simulator serving on %s\n", sim.URL())
+	served := make(chan error, 1)
+	go func() {
+		served <- sim.Serve()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+	select {
+	case err := <-served:
+		return err
+	case <-stop:
+	case <-timeout:
+	}
+	sim.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	problems := sim.Errors()
+	fmt.Fprintf(os.Stderr, "%d requests, %d documents, %d errors\n", sim.Requests(), documents, len(problems))
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "  %s\n", problem)
+	}
+	return nil
+}
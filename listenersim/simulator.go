@@ -0,0 +1,416 @@
+// Package listenersim simulates the Logz.io bulk listener in process, for the tests of the plugin and
+// for local integration testing with the listener-sim command. It accepts the NDJSON bulks the shipper
+// sends to /?token=<token>, records their documents and answers the requests from a script of faults:
+// latency, status codes, connection resets and partial reads. Bulks over the size limit get a 413.
+package listenersim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Document is a log document of a bulk the simulator accepted
+type Document struct {
+	Token    string
+	Received time.Time
+	Fields   map[string]interface{}
+	Raw      []byte
+}
+
+// Fault is how the simulator answers a request. The zero Fault accepts the bulk with the default
+// status of the simulator.
+type Fault struct {
+	// Latency is waited before the request is read
+	Latency time.Duration
+	// Status answers the request without recording it, unless it is 2xx
+	Status int
+	// Reset closes the connection without an answer
+	Reset bool
+	// PartialRead reads that many bytes of the body and then resets the connection
+	PartialRead int
+}
+
+func (f Fault) String() string {
+	var step string
+	switch {
+	case f.Reset:
+		step = "reset"
+	case f.PartialRead > 0:
+		step = fmt.Sprintf("partial=%d", f.PartialRead)
+	case f.Status != 0:
+		step = strconv.Itoa(f.Status)
+	default:
+		step = "ok"
+	}
+	if f.Latency > 0 {
+		step += "+" + f.Latency.String()
+	}
+	return step
+}
+
+// ParseScript parses a comma separated script of faults. A step is a status code, ok for the default
+// status, reset or partial=<bytes>, with an optional +<duration> latency, e.g. 500+2s,reset,ok.
+func ParseScript(script string) ([]Fault, error) {
+	var faults []Fault
+	for _, step := range strings.Split(script, ",") {
+		step = strings.TrimSpace(step)
+		if step == "" {
+			continue
+		}
+		var fault Fault
+		if i := strings.Index(step, "+"); i >= 0 {
+			latency, err := time.ParseDuration(step[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid latency of step %s: %s", step, err)
+			}
+			fault.Latency = latency
+			step = step[:i]
+		}
+		switch {
+		case step == "ok":
+		case step == "reset":
+			fault.Reset = true
+		case strings.HasPrefix(step, "partial="):
+			n, err := strconv.Atoi(strings.TrimPrefix(step, "partial="))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid partial read %s", step)
+			}
+			fault.PartialRead = n
+		default:
+			status, err := strconv.Atoi(step)
+			if err != nil || status < 100 || status > 599 {
+				return nil, fmt.Errorf("invalid step %s, it must be a status code, ok, reset or partial=<bytes>", step)
+			}
+			fault.Status = status
+		}
+		faults = append(faults, fault)
+	}
+	return faults, nil
+}
+
+// Config is the behavior of a simulator
+type Config struct {
+	// Tokens are the accepted tokens, any token is accepted when it is empty
+	Tokens []string
+	// MaxBodySize answers bigger bulks with 413, 0 has no limit
+	MaxBodySize int64
+	// Status answers the accepted bulks, 200 when it is 0
+	Status int
+	// Latency is waited before every request, on top of the latency of its fault
+	Latency time.Duration
+	// Script are the faults of the requests in order, the requests after it get the zero Fault
+	Script []Fault
+	// Loop starts the script over when it ends
+	Loop bool
+}
+
+// bulkResponse is the body of the answer to a bulk, like the one of the listener
+type bulkResponse struct {
+	SuccessfulLines int `json:"successfulLines"`
+	MalformedLines  int `json:"malformedLines"`
+	EmptyLogLines   int `json:"emptyLogLines"`
+}
+
+// Simulator is an http.Handler that simulates the listener, Start serves it on a local port
+type Simulator struct {
+	mu         sync.Mutex
+	config     Config
+	tokens     map[string]bool
+	step       int
+	requests   int
+	documents  []Document
+	errors     []string
+	onDocument func(Document)
+	ln         net.Listener
+	server     *http.Server
+}
+
+// New returns a simulator with config
+func New(config Config) *Simulator {
+	s := &Simulator{}
+	s.SetConfig(config)
+	return s
+}
+
+// SetConfig replaces the config, the script starts from its first step
+func (s *Simulator) SetConfig(config Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config = config
+	s.tokens = make(map[string]bool)
+	for _, token := range config.Tokens {
+		s.tokens[token] = true
+	}
+	s.step = 0
+}
+
+// SetScript replaces the script of the requests, it starts from its first step
+func (s *Simulator) SetScript(script []Fault, loop bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.Script = script
+	s.config.Loop = loop
+	s.step = 0
+}
+
+// SetStatus sets the status of the accepted bulks
+func (s *Simulator) SetStatus(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.Status = status
+}
+
+// OnDocument calls fn with every accepted document instead of recording it. The bulks are handled
+// concurrently, so fn can be called from several goroutines.
+func (s *Simulator) OnDocument(fn func(Document)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onDocument = fn
+}
+
+// Listen binds the simulator to addr, e.g. 127.0.0.1:0 for a free port, so its URL is known before
+// it serves
+func (s *Simulator) Listen(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ln = ln
+	s.server = &http.Server{Handler: s}
+	return nil
+}
+
+// Serve serves the requests until Close
+func (s *Simulator) Serve() error {
+	s.mu.Lock()
+	server, ln := s.server, s.ln
+	s.mu.Unlock()
+	if server == nil {
+		return fmt.Errorf("the simulator is not listening")
+	}
+	if err := server.Serve(ln); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Start listens on addr and serves in the background
+func (s *Simulator) Start(addr string) error {
+	if err := s.Listen(addr); err != nil {
+		return err
+	}
+	go s.Serve()
+	return nil
+}
+
+// URL is the url of the listener to configure the senders with
+func (s *Simulator) URL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return ""
+	}
+	return "http://" + s.ln.Addr().String()
+}
+
+// Close stops serving
+func (s *Simulator) Close() error {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+	if server == nil {
+		return nil
+	}
+	return server.Close()
+}
+
+// Requests returns how many requests the simulator answered, or reset
+func (s *Simulator) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Documents returns the recorded documents in the order they were received
+func (s *Simulator) Documents() []Document {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Document(nil), s.documents...)
+}
+
+// Errors returns what the simulator didn't expect from the clients: malformed lines, unknown tokens
+// and wrong methods
+func (s *Simulator) Errors() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.errors...)
+}
+
+// Reset forgets the documents, errors and requests, and starts the script over
+func (s *Simulator) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.documents = nil
+	s.errors = nil
+	s.requests = 0
+	s.step = 0
+}
+
+func (s *Simulator) nextFault() (Fault, Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	var fault Fault
+	if script := s.config.Script; len(script) > 0 {
+		if s.step >= len(script) && s.config.Loop {
+			s.step = 0
+		}
+		if s.step < len(script) {
+			fault = script[s.step]
+			s.step++
+		}
+	}
+	return fault, s.config
+}
+
+func (s *Simulator) reportError(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errors = append(s.errors, fmt.Sprintf(format, args...))
+}
+
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	fault, config := s.nextFault()
+	if latency := config.Latency + fault.Latency; latency > 0 {
+		select {
+		case <-time.After(latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if r.Method != http.MethodPost {
+		s.reportError("unexpected method %s", r.Method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	s.mu.Lock()
+	known := len(s.tokens) == 0 || s.tokens[token]
+	s.mu.Unlock()
+	if !known {
+		s.reportError("unknown token %q", token)
+		http.Error(w, "unknown token", http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case fault.Reset:
+		resetConnection(w)
+		return
+	case fault.PartialRead > 0:
+		io.CopyN(ioutil.Discard, r.Body, int64(fault.PartialRead))
+		resetConnection(w)
+		return
+	case fault.Status != 0 && (fault.Status < 200 || fault.Status >= 300):
+		io.Copy(ioutil.Discard, r.Body)
+		http.Error(w, http.StatusText(fault.Status), fault.Status)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if config.MaxBodySize > 0 {
+		if r.ContentLength > config.MaxBodySize {
+			http.Error(w, "request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		body = io.LimitReader(r.Body, config.MaxBodySize+1)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return
+	}
+	if config.MaxBodySize > 0 && int64(len(data)) > config.MaxBodySize {
+		http.Error(w, "request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	response := s.record(token, data)
+	status := fault.Status
+	if status == 0 {
+		status = config.Status
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if response.MalformedLines > 0 {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// record parses the NDJSON lines of a bulk and records its documents. The valid lines of a bulk are
+// kept even when other lines are malformed.
+func (s *Simulator) record(token string, data []byte) bulkResponse {
+	var response bulkResponse
+	received := time.Now()
+	var docs []Document
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		raw := bytes.TrimSpace(scanner.Bytes())
+		if len(raw) == 0 {
+			response.EmptyLogLines++
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			response.MalformedLines++
+			s.reportError("malformed line %d: %s: %s", line, err, raw)
+			continue
+		}
+		response.SuccessfulLines++
+		docs = append(docs, Document{Token: token, Received: received, Fields: fields, Raw: append([]byte(nil), raw...)})
+	}
+	s.mu.Lock()
+	onDocument := s.onDocument
+	if onDocument == nil {
+		s.documents = append(s.documents, docs...)
+	}
+	s.mu.Unlock()
+	if onDocument != nil {
+		for _, doc := range docs {
+			onDocument(doc)
+		}
+	}
+	return response
+}
+
+// resetConnection closes the connection of the request with a TCP reset
+func resetConnection(w http.ResponseWriter) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
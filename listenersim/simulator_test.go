@@ -0,0 +1,137 @@
+package listenersim
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startSimulator(t *testing.T, config Config) *Simulator {
+	sim := New(config)
+	if err := sim.Start("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return sim
+}
+
+func post(sim *Simulator, token string, body string) (int, string, error) {
+	resp, err := http.Post(sim.URL()+"/?token="+token, "text/plain", strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	data, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(data), nil
+}
+
+func TestSimulatorNDJSON(t *testing.T) {
+	sim := startSimulator(t, Config{Tokens: []string{"token"}})
+	defer sim.Close()
+	// a brace in a message doesn't split the document
+	body := `{"message":"a },{ b","n":1}` + "\n\n" + `{"message":"}\n{"}` + "\n" + `{"broken":` + "\n" + `{"message":"last"}` + "\n"
+	status, response, err := post(sim, "token", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusBadRequest || !strings.Contains(response, `"successfulLines":3`) ||
+		!strings.Contains(response, `"malformedLines":1`) || !strings.Contains(response, `"emptyLogLines":1`) {
+		t.Fatalf("Unexpected answer %d: %s", status, response)
+	}
+	var messages []interface{}
+	for _, doc := range sim.Documents() {
+		if doc.Token != "token" {
+			t.Fatalf("Unexpected token %s", doc.Token)
+		}
+		messages = append(messages, doc.Fields["message"])
+	}
+	if expected := []interface{}{"a },{ b", "}\n{", "last"}; !reflect.DeepEqual(messages, expected) {
+		t.Fatalf("Expected %q, got %q", expected, messages)
+	}
+	if errors := sim.Errors(); len(errors) != 1 || !strings.Contains(errors[0], "malformed line 4") {
+		t.Fatalf("Unexpected errors: %v", errors)
+	}
+}
+
+func TestSimulatorToken(t *testing.T) {
+	sim := startSimulator(t, Config{Tokens: []string{"token"}})
+	defer sim.Close()
+	for _, token := range []string{"other", ""} {
+		if status, _, err := post(sim, token, `{"message":"1"}`); err != nil || status != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for token %q, got %d %v", token, status, err)
+		}
+	}
+	if len(sim.Documents()) != 0 || len(sim.Errors()) != 2 {
+		t.Fatalf("Expected the bulks to be rejected: %v", sim.Errors())
+	}
+}
+
+func TestSimulatorScript(t *testing.T) {
+	script, err := ParseScript("500,reset, partial=4+50ms,ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(script) != 4 || script[2].PartialRead != 4 || script[2].Latency != 50*time.Millisecond || script[2].String() != "partial=4+50ms" {
+		t.Fatalf("Unexpected script %v", script)
+	}
+	sim := startSimulator(t, Config{Script: script, Loop: true})
+	defer sim.Close()
+	expect := func(expected int) {
+		t.Helper()
+		status, _, err := post(sim, "any", `{"message":"`+strings.Repeat("x", 1024)+`"}`)
+		if expected == 0 {
+			if err == nil {
+				t.Fatalf("Expected the connection to be reset, got %d", status)
+			}
+			return
+		}
+		if err != nil || status != expected {
+			t.Fatalf("Expected %d, got %d %v", expected, status, err)
+		}
+	}
+	expect(http.StatusInternalServerError)
+	expect(0)
+	start := time.Now()
+	expect(0)
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("Expected the latency of the step")
+	}
+	expect(http.StatusOK)
+	// the script starts over
+	expect(http.StatusInternalServerError)
+	if len(sim.Documents()) != 1 || sim.Requests() != 5 {
+		t.Fatalf("Expected only the accepted bulk to be recorded, %d documents of %d requests", len(sim.Documents()), sim.Requests())
+	}
+
+	for _, invalid := range []string{"600", "partial=x", "200+1y", "slow"} {
+		if _, err := ParseScript(invalid); err == nil {
+			t.Fatalf("Expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestSimulatorSizeLimit(t *testing.T) {
+	sim := startSimulator(t, Config{MaxBodySize: 64})
+	defer sim.Close()
+	if status, _, err := post(sim, "token", `{"message":"`+strings.Repeat("x", 64)+`"}`); err != nil || status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413, got %d %v", status, err)
+	}
+	// without a content length the body is read up to the limit
+	resp, err := http.Post(sim.URL()+"/?token=token", "text/plain", ioutil.NopCloser(bytes.NewReader(bytes.Repeat([]byte("x"), 128))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413 for a chunked bulk, got %d", resp.StatusCode)
+	}
+	if status, _, err := post(sim, "token", `{"message":"small"}`); err != nil || status != http.StatusOK {
+		t.Fatalf("Expected 200, got %d %v", status, err)
+	}
+	if len(sim.Documents()) != 1 {
+		t.Fatalf("Expected only the small bulk to be recorded, got %d", len(sim.Documents()))
+	}
+}
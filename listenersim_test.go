@@ -0,0 +1,20 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestListenerSimCommand(t *testing.T) {
+	var out bytes.Buffer
+	if err := listenerSimCommand([]string{"--addr", "127.0.0.1:0", "--script", "500,slow"}, &out); err == nil {
+		t.Fatal("Expected an error for an invalid script")
+	}
+	if err := listenerSimCommand([]string{"--addr", "127.0.0.1:0", "--max-body-size", "big"}, &out); err == nil {
+		t.Fatal("Expected an error for an invalid size")
+	}
+	if err := listenerSimCommand([]string{"--addr", "127.0.0.1:0", "--tokens", "a,b", "--script", "500,reset,ok",
+		"--max-body-size", "1m", "--duration", "100ms"}, &out); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	protoio "github.com/gogo/protobuf/io"
+	"github.com/tonistiigi/fifo"
+)
+
+const (
+	// workloadText is a line of text, workloadJSON a JSON object for logzio-format=json, and
+	// workloadPartial a long line that docker splits in partial entries
+	workloadText    = "text"
+	workloadJSON    = "json"
+	workloadPartial = "partial"
+
+	// dockerPartialSize is where docker splits a long line in partial entries
+	dockerPartialSize = 16 * 1024
+
+	defaultLoadLineSize        = 256
+	defaultLoadPartialLineSize = 64 * 1024
+)
+
+// loadConfig is a run of the load generator
+type loadConfig struct {
+	workload string
+	lines    int
+	// lineSize is the size of every line, 0 is the default of the workload
+	lineSize int
+	// rate is how many lines are written per second, 0 writes them as fast as the driver reads them
+	rate int
+	// dir holds the FIFO and the disk queue of the run
+	dir     string
+	timeout time.Duration
+}
+
+// loadResult is what a run measured. Lines and bytes are the lines the listener received, the allocs
+// are of the whole process, generator and listener included.
+type loadResult struct {
+	workload   string
+	lines      int
+	bytes      int64
+	elapsed    time.Duration
+	allocs     uint64
+	allocBytes uint64
+	latencies  []time.Duration
+}
+
+func (r *loadResult) linesPerSecond() float64 {
+	return float64(r.lines) / r.elapsed.Seconds()
+}
+
+func (r *loadResult) bytesPerSecond() float64 {
+	return float64(r.bytes) / r.elapsed.Seconds()
+}
+
+// latency returns the end-to-end latency of the quantile q of the lines, from the FIFO to the listener
+func (r *loadResult) latency(q float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := int(q * float64(len(r.latencies)-1))
+	return r.latencies[i]
+}
+
+func (r *loadResult) print(out io.Writer) {
+	fmt.Fprintf(out, "workload:   %s\n", r.workload)
+	fmt.Fprintf(out, "lines:      %d in %s\n", r.lines, r.elapsed)
+	fmt.Fprintf(out, "throughput: %.0f lines/s, %.2f MB/s\n", r.linesPerSecond(), r.bytesPerSecond()/(1024*1024))
+	if r.lines > 0 {
+		fmt.Fprintf(out, "allocs:     %d allocs/line, %d B/line\n", r.allocs/uint64(r.lines), r.allocBytes/uint64(r.lines))
+	}
+	fmt.Fprintf(out, "latency:    p50 %s, p90 %s, p99 %s, max %s\n",
+		r.latency(0.5), r.latency(0.9), r.latency(0.99), r.latency(1))
+}
+
+// loadLine returns the line seq of the workload. It starts with the sequence and the time it is
+// written, so the listener can tell the latency.
+func loadLine(workload string, seq int, size int, sent time.Time) []byte {
+	var buf bytes.Buffer
+	if workload == workloadJSON {
+		fmt.Fprintf(&buf, `{"seq":%d,"sent":%d,"pad":"`, seq, sent.UnixNano())
+	} else {
+		fmt.Fprintf(&buf, "load %d %d ", seq, sent.UnixNano())
+	}
+	pad := size - buf.Len()
+	if workload == workloadJSON {
+		pad -= len(`"}`)
+	}
+	for i := 0; i < pad; i++ {
+		buf.WriteByte('a' + byte(i%26))
+	}
+	if workload == workloadJSON {
+		buf.WriteString(`"}`)
+	}
+	return buf.Bytes()
+}
+
+// parseLoadMessage returns the sequence and the sent time of a message of the listener
+func parseLoadMessage(message interface{}) (int, time.Time, bool) {
+	switch m := message.(type) {
+	case map[string]interface{}:
+		seq, ok := m["seq"].(float64)
+		sent, ok2 := m["sent"].(float64)
+		return int(seq), time.Unix(0, int64(sent)), ok && ok2
+	case string:
+		fields := strings.SplitN(m, " ", 4)
+		if len(fields) < 3 || fields[0] != "load" {
+			return 0, time.Time{}, false
+		}
+		seq, err := strconv.Atoi(fields[1])
+		sent, err2 := strconv.ParseInt(fields[2], 10, 64)
+		return seq, time.Unix(0, sent), err == nil && err2 == nil
+	}
+	return 0, time.Time{}, false
+}
+
+// writeLoadEntries writes the lines of the workload to the FIFO the way docker does: framed
+// LogEntry messages, long lines in partial entries with their partial log metadata
+func writeLoadEntries(w io.Writer, cfg loadConfig, size int) error {
+	enc := protoio.NewUint32DelimitedWriter(w, binary.BigEndian)
+	var interval time.Duration
+	if cfg.rate > 0 {
+		interval = time.Second / time.Duration(cfg.rate)
+	}
+	start := time.Now()
+	for seq := 0; seq < cfg.lines; seq++ {
+		if interval > 0 {
+			if wait := time.Until(start.Add(time.Duration(seq) * interval)); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		now := time.Now()
+		line := loadLine(cfg.workload, seq, size, now)
+		if len(line) <= dockerPartialSize {
+			entry := logEntry{LogEntry: logdriver.LogEntry{Source: "stdout", TimeNano: now.UnixNano(), Line: line}}
+			if err := enc.WriteMsg(&entry); err != nil {
+				return err
+			}
+			continue
+		}
+		id := fmt.Sprintf("load-%d", seq)
+		for ordinal := int32(1); len(line) > 0; ordinal++ {
+			chunk := line
+			if len(chunk) > dockerPartialSize {
+				chunk = chunk[:dockerPartialSize]
+			}
+			line = line[len(chunk):]
+			entry := logEntry{
+				LogEntry:           logdriver.LogEntry{Source: "stdout", TimeNano: now.UnixNano(), Line: chunk, Partial: len(line) > 0},
+				PartialLogMetadata: &partialLogMetadata{Last: len(line) == 0, ID: id, Ordinal: ordinal},
+			}
+			if err := enc.WriteMsg(&entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runLoad writes the lines of cfg to a container of a driver that ships them to a local mock of the
+// listener, and measures them until the mock received all of them
+func runLoad(cfg loadConfig, reporter mockReporter) (*loadResult, error) {
+	size := cfg.lineSize
+	if size == 0 {
+		size = defaultLoadLineSize
+		if cfg.workload == workloadPartial {
+			size = defaultLoadPartialLineSize
+		}
+	}
+	format := defaultFormat
+	switch cfg.workload {
+	case workloadText, workloadPartial:
+	case workloadJSON:
+		format = jsonFormat
+	default:
+		return nil, fmt.Errorf("unknown workload %s, it must be %s, %s or %s\n", cfg.workload, workloadText, workloadJSON, workloadPartial)
+	}
+
+	result := &loadResult{workload: cfg.workload, latencies: make([]time.Duration, 0, cfg.lines)}
+	var mu sync.Mutex
+	done := make(chan struct{})
+	mock := NewtestHTTPMock(reporter, nil)
+	mock.setStatusCode(http.StatusOK)
+	mock.setOnMessage(func(message map[string]interface{}, received time.Time) {
+		seq, sent, ok := parseLoadMessage(message["message"])
+		if !ok || seq >= cfg.lines {
+			reporter.Errorf("unexpected message: %v", message["message"])
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		result.lines++
+		result.bytes += int64(size)
+		result.latencies = append(result.latencies, received.Sub(sent))
+		if result.lines == cfg.lines {
+			close(done)
+		}
+	})
+	go mock.Serve()
+	defer mock.Close()
+
+	d := &Driver{
+		logs:    make(map[string]*ContainerLoggersCtx),
+		idx:     make(map[string]*ContainerLoggersCtx),
+		senders: make(map[string]*SenderConfigurations),
+	}
+	info := logger.Info{
+		Config: map[string]string{
+			logzioURL:       mock.URL(),
+			logzioToken:     mock.Token(),
+			logzioFormat:    format,
+			logzioDirPath:   filepath.Join(cfg.dir, "queue"),
+			logzioLocalLog:  localLogNone,
+			logzioPreflight: preflightOff,
+		},
+		ContainerID:   "loadgeneratorcontainer",
+		ContainerName: "/load-" + cfg.workload,
+		LogPath:       filepath.Join(cfg.dir, "container", "container.log"),
+	}
+	if err := os.MkdirAll(cfg.dir, 0755); err != nil {
+		return nil, err
+	}
+	file := filepath.Join(cfg.dir, "load.fifo")
+	os.Remove(file)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	// docker opens the FIFO for writing before it asks the plugin to read it
+	w, err := fifo.OpenFifo(context.Background(), file, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_NONBLOCK, 0700)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.StartLogging(file, info); err != nil {
+		w.Close()
+		return nil, err
+	}
+	writeErr := writeLoadEntries(w, cfg, size)
+	w.Close()
+
+	var timeout <-chan time.Time
+	if cfg.timeout > 0 {
+		timeout = time.After(cfg.timeout)
+	}
+	select {
+	case <-done:
+	case <-timeout:
+	}
+	result.elapsed = time.Since(start)
+	runtime.ReadMemStats(&after)
+	d.StopLogging(file)
+	d.mu.Lock()
+	for _, lf := range d.idx {
+		lf.logzioLogger.Close()
+	}
+	d.mu.Unlock()
+	os.Remove(file)
+
+	mu.Lock()
+	defer mu.Unlock()
+	result.allocs = after.Mallocs - before.Mallocs
+	result.allocBytes = after.TotalAlloc - before.TotalAlloc
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	if writeErr != nil {
+		return result, writeErr
+	}
+	if result.lines < cfg.lines {
+		return result, fmt.Errorf("the listener received %d of %d lines in %s\n", result.lines, cfg.lines, cfg.timeout)
+	}
+	return result, nil
+}
+
+// logReporter reports the problems of the mock listener to the plugin log
+type logReporter struct{}
+
+func (logReporter) Errorf(format string, args ...interface{}) { logrus.Errorf(format, args...) }
+func (logReporter) Fatal(args ...interface{})                 { logrus.Error(args...) }
+func (logReporter) Fatalf(format string, args ...interface{}) { logrus.Errorf(format, args...) }
+func (logReporter) Log(args ...interface{})                   { logrus.Debug(args...) }
+func (logReporter) Logf(format string, args ...interface{})   { logrus.Debugf(format, args...) }
+
+// loadCommand runs the load generator, e.g.
+// logzio-logging-plugin load --workload json --lines 100000
+func loadCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("load", flag.ContinueOnError)
+	workloads := flags.String("workload", workloadText, "comma separated workloads: text, json or partial")
+	lines := flags.Int("lines", 100000, "lines to write of every workload")
+	size := flags.Int("size", 0, fmt.Sprintf("size of a line, defaults to %d and %d for partial", defaultLoadLineSize, defaultLoadPartialLineSize))
+	rate := flags.Int("rate", 0, "lines to write per second, 0 writes as fast as the driver reads")
+	dir := flags.String("dir", "", "directory of the FIFO and the disk queue, a temporary directory when empty")
+	timeout := flags.Duration("timeout", time.Minute*5, "how long to wait for the listener to receive the lines")
+	drainTimeout := flags.Duration("drain-timeout", time.Second, "how often the sender drains the disk queue, "+envLogsDrainTimeout)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *lines <= 0 {
+		return errors.New("usage: load [--workload text,json,partial] [--lines <n>] [--size <bytes>] [--rate <lines/s>] [--dir <dir>]")
+	}
+	runDir := *dir
+	if runDir == "" {
+		tmp, err := ioutil.TempDir("", "logzio-load")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		runDir = tmp
+	}
+	os.Setenv(envLogsDrainTimeout, drainTimeout.String())
+	logrus.SetLevel(logrus.WarnLevel)
+
+	for i, workload := range strings.Split(*workloads, ",") {
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		result, err := runLoad(loadConfig{
+			workload: workload,
+			lines:    *lines,
+			lineSize: *size,
+			rate:     *rate,
+			dir:      filepath.Join(runDir, workload),
+			timeout:  *timeout,
+		}, logReporter{})
+		if result != nil {
+			result.print(out)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunLoad(t *testing.T) {
+	dir, err := filepath.Abs(fmt.Sprintf("./%s", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv(envLogsDrainTimeout, "100ms")
+	defer os.Setenv(envLogsDrainTimeout, "5s")
+	for _, workload := range []string{workloadText, workloadJSON, workloadPartial} {
+		result, err := runLoad(loadConfig{
+			workload: workload,
+			lines:    50,
+			dir:      filepath.Join(dir, workload),
+			timeout:  time.Second * 30,
+		}, t)
+		if err != nil {
+			t.Fatalf("%s: %s", workload, err)
+		}
+		if result.lines != 50 || len(result.latencies) != 50 || result.latency(1) <= 0 {
+			t.Fatalf("%s: unexpected result %+v", workload, result)
+		}
+	}
+	if _, err := runLoad(loadConfig{workload: "xml", lines: 1, dir: dir}, t); err == nil {
+		t.Fatal("Expected an error for an unknown workload")
+	}
+}
+
+// BenchmarkLoad writes b.N lines of every workload to the FIFO of a container, until the listener
+// received them. The allocs are of the whole process, the listener mock included.
+func BenchmarkLoad(b *testing.B) {
+	os.Setenv(envLogsDrainTimeout, "100ms")
+	defer os.Setenv(envLogsDrainTimeout, "5s")
+	for _, workload := range []string{workloadText, workloadJSON, workloadPartial} {
+		b.Run(workload, func(b *testing.B) {
+			dir, err := filepath.Abs(fmt.Sprintf("./%s", b.Name()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			size := defaultLoadLineSize
+			if workload == workloadPartial {
+				size = defaultLoadPartialLineSize
+			}
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			result, err := runLoad(loadConfig{workload: workload, lines: b.N, dir: dir, timeout: time.Minute * 5}, b)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Logf("%d lines: %.0f lines/s, latency p50 %s, p99 %s", result.lines, result.linesPerSecond(),
+				result.latency(0.5), result.latency(0.99))
+		})
+	}
+}
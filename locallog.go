@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/daemon/logger/jsonfilelog"
+	"github.com/docker/go-units"
+)
+
+const (
+	//log-opt
+	logzioLocalLog = "logzio-local-log"
+	localMaxSize   = "max-size"
+	localMaxFile   = "max-file"
+	localCompress  = "compress"
+
+	envLocalLog         = "LOGZIO_LOCAL_LOG"
+	envLocalLogMaxSize  = "LOGZIO_LOCAL_LOG_MAX_SIZE"
+	envLocalLogMaxFile  = "LOGZIO_LOCAL_LOG_MAX_FILE"
+	envLocalLogCompress = "LOGZIO_LOCAL_LOG_COMPRESS"
+
+	// localLogJSON is the json-file copy of docker, read by docker logs
+	localLogJSON = "json"
+	// localLogLocal writes the log entries as protobuf records, in smaller files that can be compressed
+	localLogLocal = "local"
+	// localLogNone keeps no copy, docker logs does not work for the container
+	localLogNone = "none"
+
+	defaultLocalLog = localLogJSON
+	// the defaults of the local driver of docker
+	defaultLocalMaxSize  = 20 * 1000 * 1000
+	defaultLocalMaxFile  = 5
+	defaultLocalCompress = true
+
+	localFollowInterval = time.Millisecond * 200
+	// localMaxEntrySize guards the reader from a corrupted length prefix
+	localMaxEntrySize = 1e6
+)
+
+// localLogConfig is how the copy read by docker logs is kept. A maxSize of -1 does not rotate the file.
+type localLogConfig struct {
+	mode     string
+	maxSize  int64
+	maxFile  int
+	compress bool
+}
+
+// getLocalLog reads the local copy options of a container, falling back to the plugin env
+func getLocalLog(loggerInfo logger.Info) (*localLogConfig, error) {
+	config := &localLogConfig{mode: getOptOrEnv(loggerInfo, logzioLocalLog, envLocalLog), maxSize: -1, maxFile: 1}
+	switch config.mode {
+	case "":
+		config.mode = defaultLocalLog
+	case localLogJSON, localLogLocal, localLogNone:
+	default:
+		return nil, fmt.Errorf("%s must be one of %s, %s or %s: %s\n", logzioLocalLog,
+			localLogJSON, localLogLocal, localLogNone, config.mode)
+	}
+	if config.mode == localLogLocal {
+		config.maxSize, config.maxFile, config.compress = defaultLocalMaxSize, defaultLocalMaxFile, defaultLocalCompress
+	}
+
+	if str := getOptOrEnv(loggerInfo, localMaxSize, envLocalLogMaxSize); str != "" {
+		size, err := units.FromHumanSize(str)
+		if err != nil || size < 1 {
+			return nil, fmt.Errorf("%s is not a valid size: %s\n", localMaxSize, str)
+		}
+		config.maxSize = size
+	}
+	if str := getOptOrEnv(loggerInfo, localMaxFile, envLocalLogMaxFile); str != "" {
+		maxFile, err := strconv.Atoi(str)
+		if err != nil || maxFile < 1 {
+			return nil, fmt.Errorf("%s must be a number of at least 1: %s\n", localMaxFile, str)
+		}
+		config.maxFile = maxFile
+	}
+	if str := getOptOrEnv(loggerInfo, localCompress, envLocalLogCompress); str != "" {
+		compress, err := strconv.ParseBool(str)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be true or false: %s\n", localCompress, str)
+		}
+		if compress && config.mode != localLogLocal {
+			return nil, fmt.Errorf("%s is only supported with %s=%s\n", localCompress, logzioLocalLog, localLogLocal)
+		}
+		config.compress = compress
+	}
+	return config, nil
+}
+
+// newLocalLogger creates the copy read by docker logs, it returns nil with logzio-local-log=none
+func newLocalLogger(loggerInfo logger.Info) (logger.Logger, error) {
+	config, err := getLocalLog(loggerInfo)
+	if err != nil {
+		return nil, err
+	}
+	switch config.mode {
+	case localLogNone:
+		return nil, nil
+	case localLogLocal:
+		return newLocalFileLogger(loggerInfo.LogPath, config)
+	default:
+		// jsonfilelog reads max-size and max-file from the log-opts, the env defaults are passed the same way
+		info := loggerInfo
+		info.Config = make(map[string]string, len(loggerInfo.Config)+2)
+		for key, value := range loggerInfo.Config {
+			info.Config[key] = value
+		}
+		if config.maxSize > 0 {
+			info.Config[localMaxSize] = strconv.FormatInt(config.maxSize, 10)
+		}
+		info.Config[localMaxFile] = strconv.Itoa(config.maxFile)
+		return jsonfilelog.New(info)
+	}
+}
+
+// localFileLogger writes the log entries as uint32 length prefixed protobuf records, the framing of the
+// FIFO docker writes to the plugin. Rotated files are named <path>.1 to <path>.<max-file - 1>, newest first,
+// with a .gz suffix when they are compressed.
+type localFileLogger struct {
+	mu      sync.Mutex
+	path    string
+	config  *localLogConfig
+	file    *os.File
+	size    int64
+	buf     []byte
+	closed  bool
+	written chan struct{}
+}
+
+func newLocalFileLogger(path string, config *localLogConfig) (*localFileLogger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &localFileLogger{path: path, config: config, file: file, size: size, written: make(chan struct{})}, nil
+}
+
+func (l *localFileLogger) Log(msg *logger.Message) error {
+	entry := logdriver.LogEntry{
+		Source:   msg.Source,
+		TimeNano: msg.Timestamp.UnixNano(),
+		Line:     msg.Line,
+		Partial:  msg.Partial,
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return fmt.Errorf("local log of %s is closed\n", l.path)
+	}
+	size := entry.Size()
+	if cap(l.buf) < size+4 {
+		l.buf = make([]byte, size+4)
+	}
+	l.buf = l.buf[:size+4]
+	binary.BigEndian.PutUint32(l.buf, uint32(size))
+	if _, err := entry.MarshalTo(l.buf[4:]); err != nil {
+		return err
+	}
+	if l.config.maxSize > 0 && l.size > 0 && l.size+int64(len(l.buf)) > l.config.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(l.buf)
+	l.size += int64(n)
+	// wake up the readers following the file
+	close(l.written)
+	l.written = make(chan struct{})
+	return err
+}
+
+// rotate moves the file to <path>.1, shifting the older files and dropping the oldest
+func (l *localFileLogger) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if l.config.maxFile > 1 {
+		for i := l.config.maxFile - 1; i > 1; i-- {
+			for _, suffix := range []string{"", ".gz"} {
+				from := fmt.Sprintf("%s.%d%s", l.path, i-1, suffix)
+				if err := os.Rename(from, fmt.Sprintf("%s.%d%s", l.path, i, suffix)); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		rotated := l.path + ".1"
+		if err := os.Rename(l.path, rotated); err != nil {
+			return err
+		}
+		if l.config.compress {
+			if err := compressFile(rotated); err != nil {
+				return err
+			}
+		}
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.size = 0
+	return nil
+}
+
+// compressFile replaces path with path.gz
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (l *localFileLogger) Name() string {
+	return localLogLocal
+}
+
+func (l *localFileLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.written)
+	return l.file.Close()
+}
+
+// ReadLogs implements logger.LogReader for the files of the local copy
+func (l *localFileLogger) ReadLogs(config logger.ReadConfig) *logger.LogWatcher {
+	watcher := logger.NewLogWatcher()
+	go l.readLogs(watcher, config)
+	return watcher
+}
+
+func (l *localFileLogger) readLogs(watcher *logger.LogWatcher, config logger.ReadConfig) {
+	defer close(watcher.Msg)
+
+	// the rotated files and the size of the current file are taken under the lock, so a rotation
+	// while reading doesn't skip or repeat entries
+	l.mu.Lock()
+	var rotated []string
+	for i := l.config.maxFile - 1; i > 0; i-- {
+		for _, suffix := range []string{".gz", ""} {
+			path := fmt.Sprintf("%s.%d%s", l.path, i, suffix)
+			if _, err := os.Stat(path); err == nil {
+				rotated = append(rotated, path)
+				break
+			}
+		}
+	}
+	current, err := os.Open(l.path)
+	size := l.size
+	l.mu.Unlock()
+	if err != nil {
+		watcher.Err <- err
+		return
+	}
+	defer current.Close()
+
+	var tail []*logger.Message
+	keep := func(msg *logger.Message) bool {
+		if !config.Since.IsZero() && msg.Timestamp.Before(config.Since) {
+			return true
+		}
+		if config.Tail < 0 {
+			return l.send(watcher, msg)
+		}
+		if config.Tail > 0 {
+			tail = append(tail, msg)
+			if len(tail) > config.Tail {
+				tail = tail[1:]
+			}
+		}
+		return true
+	}
+	for _, path := range rotated {
+		if err := readLocalFile(path, keep); err != nil {
+			watcher.Err <- err
+			return
+		}
+	}
+	if err := readLocalEntries(io.LimitReader(current, size), keep); err != nil {
+		watcher.Err <- err
+		return
+	}
+	for _, msg := range tail {
+		if !l.send(watcher, msg) {
+			return
+		}
+	}
+	if config.Follow {
+		l.follow(watcher, current, size, config.Since)
+	}
+}
+
+// send returns false once the reader is gone
+func (l *localFileLogger) send(watcher *logger.LogWatcher, msg *logger.Message) bool {
+	select {
+	case watcher.Msg <- msg:
+		return true
+	case <-watcher.WatchClose():
+		return false
+	}
+}
+
+// follow sends the entries written to the file from offset on, and moves to the new file on a rotation
+func (l *localFileLogger) follow(watcher *logger.LogWatcher, file *os.File, offset int64, since time.Time) {
+	for {
+		l.mu.Lock()
+		written, closed := l.written, l.closed
+		rotatedAway := false
+		if current, err := os.Stat(l.path); err == nil {
+			if opened, err := file.Stat(); err == nil && !os.SameFile(current, opened) {
+				rotatedAway = true
+			}
+		}
+		l.mu.Unlock()
+
+		n, err := readLocalFrom(file, offset, func(msg *logger.Message) bool {
+			if !since.IsZero() && msg.Timestamp.Before(since) {
+				return true
+			}
+			return l.send(watcher, msg)
+		})
+		offset += n
+		if err != nil {
+			if err != errReaderGone {
+				watcher.Err <- err
+			}
+			return
+		}
+		if rotatedAway {
+			// the rotated file was read to its end, the new file starts from the beginning
+			file.Close()
+			if file, err = os.Open(l.path); err != nil {
+				watcher.Err <- err
+				return
+			}
+			defer file.Close()
+			offset = 0
+			continue
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-written:
+		case <-time.After(localFollowInterval):
+		case <-watcher.WatchClose():
+			return
+		}
+	}
+}
+
+var errReaderGone = fmt.Errorf("the reader is gone")
+
+// readLocalFrom reads the complete entries of file from offset, and returns how many bytes were read
+func readLocalFrom(file *os.File, offset int64, fn func(*logger.Message) bool) (int64, error) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(file)
+	var read int64
+	for {
+		msg, n, err := readLocalEntry(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// an entry that is still being written is read on the next pass
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+		read += n
+		if !fn(msg) {
+			return read, errReaderGone
+		}
+	}
+}
+
+// readLocalFile reads a rotated file, decompressing it when it ends with .gz
+func readLocalFile(path string, fn func(*logger.Message) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// rotated away since it was listed
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if len(path) > 3 && path[len(path)-3:] == ".gz" {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	return readLocalEntries(r, fn)
+}
+
+func readLocalEntries(r io.Reader, fn func(*logger.Message) bool) error {
+	br := bufio.NewReader(r)
+	for {
+		msg, _, err := readLocalEntry(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fn(msg) {
+			return nil
+		}
+	}
+}
+
+// readLocalEntry reads one length prefixed entry, io.ErrUnexpectedEOF means the entry is incomplete
+func readLocalEntry(r *bufio.Reader) (*logger.Message, int64, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(prefix[:])
+	if size > localMaxEntrySize {
+		return nil, 0, fmt.Errorf("local log entry of %d bytes is larger than %d, the file is corrupted", size, int(localMaxEntrySize))
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	var entry logdriver.LogEntry
+	if err := entry.Unmarshal(data); err != nil {
+		return nil, 0, err
+	}
+	// like json-file, a complete line is read back with its newline
+	if !entry.Partial {
+		entry.Line = append(entry.Line, '\n')
+	}
+	return &logger.Message{
+		Line:      entry.Line,
+		Source:    entry.Source,
+		Timestamp: time.Unix(0, entry.TimeNano),
+		Partial:   entry.Partial,
+	}, int64(size) + 4, nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func readLocalMessages(t *testing.T, l logger.Logger, config logger.ReadConfig, count int) []string {
+	watcher := l.(logger.LogReader).ReadLogs(config)
+	defer watcher.Close()
+	var lines []string
+	timeout := time.After(5 * time.Second)
+	for count < 0 || len(lines) < count {
+		select {
+		case msg, ok := <-watcher.Msg:
+			if !ok {
+				return lines
+			}
+			lines = append(lines, strings.TrimSuffix(string(msg.Line), "\n"))
+		case err := <-watcher.Err:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("Timed out reading the local log, read %v", lines)
+		}
+	}
+	return lines
+}
+
+func TestLocalLogOptions(t *testing.T) {
+	for _, c := range []struct {
+		opts    map[string]string
+		problem string
+	}{
+		{map[string]string{logzioLocalLog: "syslog"}, "logzio-local-log must be one of"},
+		{map[string]string{localMaxSize: "lots"}, "max-size is not a valid size"},
+		{map[string]string{localMaxFile: "0"}, "max-file must be a number of at least 1"},
+		{map[string]string{localCompress: "true"}, "compress is only supported with logzio-local-log=local"},
+	} {
+		if _, err := getLocalLog(logger.Info{Config: c.opts}); err == nil || !strings.Contains(err.Error(), c.problem) {
+			t.Errorf("Expected %q for %v, got: %v", c.problem, c.opts, err)
+		}
+	}
+
+	config, err := getLocalLog(logger.Info{Config: map[string]string{logzioLocalLog: localLogLocal, localMaxFile: "3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.maxSize != defaultLocalMaxSize || config.maxFile != 3 || !config.compress {
+		t.Fatalf("Unexpected local config: %+v", config)
+	}
+
+	l, err := newLocalLogger(logger.Info{Config: map[string]string{logzioLocalLog: localLogNone}})
+	if err != nil || l != nil {
+		t.Fatalf("Expected no local logger, got: %v %v", l, err)
+	}
+}
+
+func TestLocalLogRotation(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "container.log")
+
+	l, err := newLocalLogger(logger.Info{
+		Config:  map[string]string{logzioLocalLog: localLogLocal, localMaxSize: "200", localMaxFile: "3"},
+		LogPath: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		msg := &logger.Message{Line: []byte(fmt.Sprintf("line %02d", i)), Source: "stdout", Timestamp: now.Add(time.Duration(i) * time.Second)}
+		if err := l.Log(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rotated := range []string{path + ".1.gz", path + ".2.gz"} {
+		if _, err := os.Stat(rotated); err != nil {
+			t.Errorf("Expected the rotated file %s: %s", rotated, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3.gz"); !os.IsNotExist(err) {
+		t.Errorf("Expected only max-file files to be kept: %v", err)
+	}
+
+	all := readLocalMessages(t, l, logger.ReadConfig{Tail: -1}, -1)
+	if len(all) == 0 || all[len(all)-1] != "line 19" {
+		t.Fatalf("Expected the rotated and current files in order, got %v", all)
+	}
+	for i := 1; i < len(all); i++ {
+		if all[i-1] >= all[i] {
+			t.Fatalf("Lines are out of order: %v", all)
+		}
+	}
+	if tail := readLocalMessages(t, l, logger.ReadConfig{Tail: 2}, -1); strings.Join(tail, ",") != "line 18,line 19" {
+		t.Fatalf("Unexpected tail: %v", tail)
+	}
+	since := readLocalMessages(t, l, logger.ReadConfig{Tail: -1, Since: now.Add(17 * time.Second)}, -1)
+	if strings.Join(since, ",") != "line 17,line 18,line 19" {
+		t.Fatalf("Unexpected lines since: %v", since)
+	}
+
+	// following reads the new lines, across a rotation
+	done := make(chan []string)
+	go func() {
+		done <- readLocalMessages(t, l, logger.ReadConfig{Tail: 0, Follow: true}, 10)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	for i := 20; i < 30; i++ {
+		if err := l.Log(&logger.Message{Line: []byte(fmt.Sprintf("line %02d", i)), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	followed := <-done
+	if followed[0] != "line 20" || followed[9] != "line 29" {
+		t.Fatalf("Unexpected followed lines: %v", followed)
+	}
+}
+
+func TestLocalLogJSONFile(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "container.log")
+
+	os.Setenv(envLocalLogMaxSize, "100")
+	defer os.Unsetenv(envLocalLogMaxSize)
+	l, err := newLocalLogger(logger.Info{Config: map[string]string{localMaxFile: "2"}, LogPath: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.Name() != "json-file" {
+		t.Fatalf("Expected the json-file logger by default, got %s", l.Name())
+	}
+	for i := 0; i < 10; i++ {
+		if err := l.Log(&logger.Message{Line: []byte("a line for the json file"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Fatalf("Expected max-size from the env to rotate the json file: %s", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+)
+
+// logEntry is the LogEntry docker writes to the FIFO. Newer docker versions add the partial log
+// metadata as field 5, which the vendored logdriver.LogEntry doesn't have:
+//
+//	message PartialLogEntryMetadata { bool last = 1; string id = 2; int32 ordinal = 3; }
+//	message LogEntry { ...; PartialLogEntryMetadata partial_log_metadata = 5; }
+type logEntry struct {
+	logdriver.LogEntry
+	PartialLogMetadata *partialLogMetadata
+}
+
+// partialLogMetadata ties the chunks of a message docker split: they share the id, are numbered
+// by the ordinal from 1, and the last one is marked
+type partialLogMetadata struct {
+	Last    bool
+	ID      string
+	Ordinal int32
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+
+	partialLogMetadataField = 5
+)
+
+func (e *logEntry) Reset() {
+	e.LogEntry.Reset()
+	e.PartialLogMetadata = nil
+}
+
+func (e *logEntry) Unmarshal(data []byte) error {
+	e.Reset()
+	return decodeFields(data, func(field uint64, wire uint64, value uint64, raw []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			e.Source = string(raw)
+		case field == 2 && wire == wireVarint:
+			e.TimeNano = int64(value)
+		case field == 3 && wire == wireBytes:
+			e.Line = append([]byte(nil), raw...)
+		case field == 4 && wire == wireVarint:
+			e.Partial = value != 0
+		case field == partialLogMetadataField && wire == wireBytes:
+			md := &partialLogMetadata{}
+			err := decodeFields(raw, func(field uint64, wire uint64, value uint64, raw []byte) error {
+				switch {
+				case field == 1 && wire == wireVarint:
+					md.Last = value != 0
+				case field == 2 && wire == wireBytes:
+					md.ID = string(raw)
+				case field == 3 && wire == wireVarint:
+					md.Ordinal = int32(value)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			e.PartialLogMetadata = md
+		}
+		return nil
+	})
+}
+
+func (e *logEntry) Size() int {
+	size := e.LogEntry.Size()
+	if md := e.PartialLogMetadata; md != nil {
+		n := md.size()
+		size += uvarintSize(partialLogMetadataField<<3|wireBytes) + uvarintSize(uint64(n)) + n
+	}
+	return size
+}
+
+func (e *logEntry) MarshalTo(data []byte) (int, error) {
+	n, err := e.LogEntry.MarshalTo(data)
+	if err != nil || e.PartialLogMetadata == nil {
+		return n, err
+	}
+	md := e.PartialLogMetadata
+	n += binary.PutUvarint(data[n:], partialLogMetadataField<<3|wireBytes)
+	n += binary.PutUvarint(data[n:], uint64(md.size()))
+	if md.Last {
+		n += binary.PutUvarint(data[n:], 1<<3|wireVarint)
+		n += binary.PutUvarint(data[n:], 1)
+	}
+	if md.ID != "" {
+		n += binary.PutUvarint(data[n:], 2<<3|wireBytes)
+		n += binary.PutUvarint(data[n:], uint64(len(md.ID)))
+		n += copy(data[n:], md.ID)
+	}
+	if md.Ordinal != 0 {
+		n += binary.PutUvarint(data[n:], 3<<3|wireVarint)
+		n += binary.PutUvarint(data[n:], uint64(md.Ordinal))
+	}
+	return n, nil
+}
+
+func (e *logEntry) Marshal() ([]byte, error) {
+	data := make([]byte, e.Size())
+	n, err := e.MarshalTo(data)
+	return data[:n], err
+}
+
+func (md *partialLogMetadata) size() int {
+	var n int
+	if md.Last {
+		n += 2
+	}
+	if md.ID != "" {
+		n += 1 + uvarintSize(uint64(len(md.ID))) + len(md.ID)
+	}
+	if md.Ordinal != 0 {
+		n += 1 + uvarintSize(uint64(md.Ordinal))
+	}
+	return n
+}
+
+func uvarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// decodeFields calls fn with every field of a protobuf message, value is set for varints and raw for
+// length delimited fields. Fixed size fields are skipped.
+func decodeFields(data []byte, fn func(field uint64, wire uint64, value uint64, raw []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return io.ErrUnexpectedEOF
+		}
+		data = data[n:]
+		field, wire := key>>3, key&7
+		var value uint64
+		var raw []byte
+		switch wire {
+		case wireVarint:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return io.ErrUnexpectedEOF
+			}
+			data = data[n:]
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return io.ErrUnexpectedEOF
+			}
+			raw = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case wireFixed64:
+			if len(data) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			data = data[8:]
+			continue
+		case wireFixed32:
+			if len(data) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			data = data[4:]
+			continue
+		default:
+			return fmt.Errorf("log entry has a field of the unsupported wire type %d", wire)
+		}
+		if err := fn(field, wire, value, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
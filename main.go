@@ -34,6 +34,9 @@ var logLevels = map[string]logrus.Level{
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
 	logrus.Debugf("Plugin socket is located at %s\n", socketName)
 	levelVal := os.Getenv("LOG_LEVEL")
 	if levelVal == "" {
@@ -45,6 +48,20 @@ func main() {
 		fmt.Fprintln(os.Stderr, "invalid log level: ", levelVal)
 		os.Exit(1)
 	}
+	quota, err := getDiskQuota()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	globalDiskQuota = quota
+	configFile := os.Getenv(envConfigFile)
+	if err := pluginConfigs.load(configFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if configFile != "" {
+		go pluginConfigs.watch(configFile)
+	}
 	h := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
 	handlers(&h, newDriver())
 	if err := h.ServeUnix(socketName, 0); err != nil {
@@ -1,104 +1,75 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net"
-	"net/http"
-	"testing"
+	"sync"
 	"time"
+
+	"github.com/logzio/logzio-logging-plugin/listenersim"
 )
 
+// mockReporter is where the mock reports what it didn't expect, a *testing.T or *testing.B in the
+// tests and the load command otherwise
+type mockReporter interface {
+	Errorf(format string, args ...interface{})
+	Fatal(args ...interface{})
+	Fatalf(format string, args ...interface{})
+	Log(args ...interface{})
+	Logf(format string, args ...interface{})
+}
+
+// testHTTPMock is the listener of the tests, a simulator that accepts the token of Token and records
+// the messages of the bulks
 type testHTTPMock struct {
-	batch               int
-	constStatusCode     int
-	constStatusCodeFlag bool
-	debug               bool
-	lastLog             string
-	lastMessageTime     chan time.Time
-	ln                  *net.TCPListener
-	messages            []map[string]interface{}
-	statusCodes         []int
-	test                *testing.T
-	token               string
+	debug           bool
+	lastLog         string
+	lastMessageTime chan time.Time
+	messages        []map[string]interface{}
+	mu              sync.Mutex
+	// onMessage gets the messages instead of messages when it is set
+	onMessage func(message map[string]interface{}, received time.Time)
+	sim       *listenersim.Simulator
+	test      mockReporter
+	token     string
 }
 
-func NewtestHTTPMock(t *testing.T, returnStatusCodes []int) *testHTTPMock {
-	laddr := &net.TCPAddr{IP: []byte{127, 0, 0, 1}, Port: 0, Zone: ""}
-	ln, err := net.ListenTCP("tcp", laddr)
-	if err != nil {
-		t.Fatal(err)
-	}
-	return &testHTTPMock{
-		ln:              ln,
-		batch:           0,
-		debug:           false,
+// NewtestHTTPMock returns a mock that answers the bulks with returnStatusCodes in order, and with
+// 200 once they run out
+func NewtestHTTPMock(t mockReporter, returnStatusCodes []int) *testHTTPMock {
+	m := &testHTTPMock{
 		test:            t,
-		statusCodes:     returnStatusCodes,
 		token:           "123456789",
 		lastMessageTime: make(chan time.Time, 5000),
 	}
+	var script []listenersim.Fault
+	for _, status := range returnStatusCodes {
+		script = append(script, listenersim.Fault{Status: status})
+	}
+	m.sim = listenersim.New(listenersim.Config{Tokens: []string{m.token}, Script: script})
+	m.sim.OnDocument(m.received)
+	if err := m.sim.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	return m
 }
 
-func (m *testHTTPMock) Serve() error {
-	return http.Serve(m.ln, m)
+func (m *testHTTPMock) received(doc listenersim.Document) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.debug {
+		m.test.Logf("mock received message: %s", doc.Raw)
+	}
+	if m.onMessage != nil {
+		m.onMessage(doc.Fields, doc.Received)
+	} else {
+		m.messages = append(m.messages, doc.Fields)
+	}
+	if m.lastLog != "" && doc.Fields["message"] == m.lastLog {
+		m.lastMessageTime <- doc.Received
+	}
 }
 
-//type Handler interface {
-//	ServeHTTP(ResponseWriter, *Request)
-//}
-func (m *testHTTPMock) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-
-	switch request.Method {
-	case http.MethodPost:
-		if fmt.Sprintf("%s%s", "http://", request.Host) != m.URL() {
-			m.test.Errorf("Wrong URL - %v", request.Host)
-		}
-		lastMessageTime := time.Now()
-		defer request.Body.Close()
-		reqBody := request.Body
-		body, err := ioutil.ReadAll(reqBody)
-		if err != nil {
-			m.test.Fatal(err)
-		}
-
-		jsonStart := 0
-		for jsonEnd := 0; jsonEnd < len(body); jsonEnd++ {
-			if jsonEnd == len(body)-2 || (body[jsonEnd] == '}' && body[jsonEnd+2] == '{') {
-				var message map[string]interface{}
-				err = json.Unmarshal(body[jsonStart:jsonEnd+1], &message)
-				if err != nil {
-					m.test.Log(string(body[jsonStart : jsonEnd+1]))
-					m.test.Fatal(err)
-				}
-				if m.debug {
-					m.test.Logf("mock received message: %s", string(string(body[jsonStart:jsonEnd+1])))
-				}
-				m.messages = append(m.messages, message)
-				jsonStart = jsonEnd + 1
-				if m.lastLog != "" {
-					if message["message"] == m.lastLog {
-						m.lastMessageTime <- lastMessageTime
-					}
-				}
-			}
-		}
-
-		if m.constStatusCodeFlag {
-			writer.WriteHeader(m.constStatusCode)
-		} else {
-			if m.batch > len(m.statusCodes) {
-				m.test.Fatalf("Not enough response status codes configured")
-			}
-			retStatus := m.statusCodes[m.batch]
-			writer.WriteHeader(retStatus)
-		}
-		m.batch++
-	default:
-		m.test.Errorf("Unexpected HTTP method %s", request.Method)
-		writer.WriteHeader(http.StatusBadRequest)
-	}
+func (m *testHTTPMock) Serve() error {
+	return m.sim.Serve()
 }
 
 func (m *testHTTPMock) setLastLog(lastLog string) {
@@ -109,22 +80,33 @@ func (m *testHTTPMock) Token() string {
 	return m.token
 }
 
+// Batch returns how many bulks the mock answered
 func (m *testHTTPMock) Batch() int {
-	return m.batch
+	return m.sim.Requests()
 }
 
 func (m *testHTTPMock) URL() string {
-	return "http://" + m.ln.Addr().String()
+	return m.sim.URL()
 }
 
 func (m *testHTTPMock) Close() error {
+	err := m.sim.Close()
+	m.mu.Lock()
 	close(m.lastMessageTime)
-	return m.ln.Close()
+	m.mu.Unlock()
+	return err
 }
 
+// setStatusCode answers all the next bulks with status
 func (m *testHTTPMock) setStatusCode(status int) {
-	m.constStatusCode = status
-	m.constStatusCodeFlag = true
+	m.sim.SetScript(nil, false)
+	m.sim.SetStatus(status)
+}
+
+func (m *testHTTPMock) setOnMessage(onMessage func(message map[string]interface{}, received time.Time)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onMessage = onMessage
 }
 
 func (m *testHTTPMock) setDebug(debug bool) {
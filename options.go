@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/docker/pkg/templates"
+	"github.com/docker/go-units"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+// optSpec describes a log-opt. Env is the plugin env the log-opt falls back to, and check validates
+// the value, it is nil for free text and for the files that are read when the sender is created.
+type optSpec struct {
+	name  string
+	env   string
+	check func(info logger.Info, value string) string
+}
+
+// driverOpts is the schema of the log-opts
+var driverOpts = []optSpec{
+	{logzioToken, "", checkNotEmpty},
+	{logzioTokenFile, envTokenFile, nil},
+	{logzioURL, "", checkURL},
+	{logzioDirPath, "", checkNotEmpty},
+	{logzioFormat, "", checkOneOf(defaultFormat, jsonFormat)},
+	{logzioTag, "", checkTagTemplate},
+	{logzioType, "", nil},
+	{logzioLogSource, "", nil},
+	{logzioLogAttr, "", checkJSONObject},
+	{envRegex, "", checkRegexp},
+	{dockerLabels, "", nil},
+	{dockerEnv, "", nil},
+	{logzioCACert, envCACert, nil},
+	{logzioClientCert, envClientCert, nil},
+	{logzioClientKey, envClientKey, nil},
+	{logzioTLSServerName, envTLSServerName, nil},
+	{logzioTLSMinVersion, envTLSMinVersion, checkTLSVersion},
+	{logzioProxy, envHTTPSProxy, checkProxyURL},
+	{logzioNoProxy, envNoProxy, nil},
+	{logzioRetryInitialBackoff, envRetryInitialBackoff, checkDuration},
+	{logzioRetryMaxBackoff, envRetryMaxBackoff, checkDuration},
+	{logzioRetryMultiplier, envRetryMultiplier, checkNumber},
+	{logzioRetryJitter, envRetryJitter, checkNumber},
+	{logzioRetryMaxAttempts, envRetryMaxAttempts, checkInteger},
+	{logzioRetryMaxAge, envRetryMaxAge, checkDuration},
+	{logzioBreakerFailures, envBreakerFailures, checkInteger},
+	{logzioBreakerErrorRate, envBreakerErrorRate, checkNumber},
+	{logzioBreakerWindow, envBreakerWindow, checkInteger},
+	{logzioBreakerOpenTimeout, envBreakerOpenTimeout, checkDuration},
+	{logzioBackpressure, envBackpressure,
+		checkOneOf(backpressureBlock, backpressureDropNewest, backpressureDropOldest, backpressureSpillToDisk)},
+	{logzioQueueMaxSize, envQueueMaxSize, checkSize},
+	{logzioQueueEviction, envQueueEviction, checkOneOf(string(shipper.EvictOldestFirst), string(shipper.EvictRejectNew))},
+	{logzioEncryptionKeyFile, envEncryptionKeyFile, nil},
+	{logzioPreflight, envPreflight, checkOneOf(preflightOff, preflightFail, preflightWarn)},
+	{logzioDryRun, envDryRun, checkBool},
+	{logzioDryRunFile, envDryRunFile, nil},
+	{logzioOversize, envOversize, checkOneOf(oversizeTruncate, oversizeSplit)},
+	{logzioLocalLog, envLocalLog, checkOneOf(localLogJSON, localLogLocal, localLogNone)},
+	{localMaxSize, envLocalLogMaxSize, checkHumanSize},
+	{localMaxFile, envLocalLogMaxFile, checkInteger},
+	{localCompress, envLocalLogCompress, checkBool},
+}
+
+// isDriverOpt reports whether opt is a log-opt of the driver
+func isDriverOpt(opt string) bool {
+	for _, spec := range driverOpts {
+		if spec.name == opt {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOpts returns a problem for every log-opt that is unknown or has a bad value. A value that comes
+// from the plugin env is checked too, and the problem names the env.
+func checkOpts(loggerInfo logger.Info) []string {
+	var problems []string
+	var opts []string
+	for opt := range loggerInfo.Config {
+		opts = append(opts, opt)
+	}
+	sort.Strings(opts)
+	for _, opt := range opts {
+		if !isDriverOpt(opt) {
+			problems = append(problems, fmt.Sprintf("wrong log-opt: '%s' - %s\n", opt, loggerInfo.ContainerID))
+		}
+	}
+	for _, spec := range driverOpts {
+		if spec.check == nil {
+			continue
+		}
+		name := spec.name
+		value, ok := loggerInfo.Config[spec.name]
+		if !ok {
+			if spec.env == "" {
+				continue
+			}
+			if name, value = spec.env, getOptOrEnv(loggerInfo, spec.name, spec.env); value == "" {
+				continue
+			}
+		}
+		if problem := spec.check(loggerInfo, value); problem != "" {
+			problems = append(problems, fmt.Sprintf("%s %s\n", name, problem))
+		}
+	}
+	return problems
+}
+
+func checkNotEmpty(_ logger.Info, value string) string {
+	if strings.TrimSpace(value) == "" {
+		return "can't be empty"
+	}
+	return ""
+}
+
+func checkURL(_ logger.Info, value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Sprintf("is not a valid http or https url: %s", maskURL(value))
+	}
+	return ""
+}
+
+func checkProxyURL(_ logger.Info, value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("is not a valid proxy url: %s", maskURL(value))
+	}
+	if u.Scheme != "http" {
+		return fmt.Sprintf("scheme must be http: %s", maskURL(value))
+	}
+	return ""
+}
+
+func checkOneOf(values ...string) func(logger.Info, string) string {
+	return func(_ logger.Info, value string) string {
+		for _, v := range values {
+			if value == v {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %s: %s", strings.Join(values, ", "), value)
+	}
+}
+
+func checkTLSVersion(_ logger.Info, value string) string {
+	if value == unsupportedTLSVersion {
+		return fmt.Sprintf("is not supported by the go version the plugin is built with, use 1.2: %s", value)
+	}
+	if _, ok := tlsVersions[value]; !ok {
+		return fmt.Sprintf("is not a supported version, use one of: 1.0, 1.1, 1.2: %s", value)
+	}
+	return ""
+}
+
+func checkDuration(_ logger.Info, value string) string {
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Sprintf("is not a valid duration, e.g. 500ms or 2s: %s", value)
+	}
+	return ""
+}
+
+func checkNumber(_ logger.Info, value string) string {
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return fmt.Sprintf("is not a valid number: %s", value)
+	}
+	return ""
+}
+
+func checkInteger(_ logger.Info, value string) string {
+	if _, err := strconv.Atoi(value); err != nil {
+		return fmt.Sprintf("is not a valid integer: %s", value)
+	}
+	return ""
+}
+
+func checkBool(_ logger.Info, value string) string {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Sprintf("must be true or false: %s", value)
+	}
+	return ""
+}
+
+func checkSize(_ logger.Info, value string) string {
+	if size, err := units.RAMInBytes(value); err != nil || size < 0 {
+		return fmt.Sprintf("is not a valid size, e.g. 500m or 2g: %s", value)
+	}
+	return ""
+}
+
+func checkHumanSize(_ logger.Info, value string) string {
+	if size, err := units.FromHumanSize(value); err != nil || size < 1 {
+		return fmt.Sprintf("is not a valid size, e.g. 10m or 1g: %s", value)
+	}
+	return ""
+}
+
+func checkRegexp(_ logger.Info, value string) string {
+	if _, err := regexp.Compile(value); err != nil {
+		return fmt.Sprintf("is not a valid regexp: %s", err)
+	}
+	return ""
+}
+
+func checkJSONObject(_ logger.Info, value string) string {
+	var attributes map[string]interface{}
+	if err := json.Unmarshal([]byte(value), &attributes); err != nil {
+		return fmt.Sprintf("must be a JSON object, e.g. {\"env\":\"prod\"}: %s", err)
+	}
+	return ""
+}
+
+// checkTagTemplate parses the template and runs it on the container, so unknown fields are found as well
+func checkTagTemplate(info logger.Info, value string) string {
+	tmpl, err := templates.NewParse("log-tag", value)
+	if err == nil {
+		err = tmpl.Execute(&bytes.Buffer{}, &info)
+	}
+	if err != nil {
+		return fmt.Sprintf("is not a valid template: %s", err)
+	}
+	return ""
+}
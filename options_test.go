@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func TestValidateDriverOptAggregated(t *testing.T) {
+	os.Setenv(envRetryMaxAge, "forever")
+	defer os.Unsetenv(envRetryMaxAge)
+	_, err := validateDriverOpt(logger.Info{ContainerID: "123456789", Config: map[string]string{
+		logzioToken:        "123456789",
+		logzioDirPath:      fmt.Sprintf("./%s", t.Name()),
+		logzioURL:          "listener.logz.io:8071",
+		logzioLogAttr:      `{"env": prod}`,
+		logzioFormat:       "xml",
+		logzioTag:          "{{.Nmae}}",
+		logzioBackpressure: "drop-all",
+		logzioQueueMaxSize: "big",
+		envRegex:           "[",
+		"logzio-colour":    "red",
+	}})
+	if err == nil {
+		t.Fatal("Expected the log-opts to be rejected")
+	}
+	for _, problem := range []string{
+		"wrong log-opt: 'logzio-colour' - 123456789\n",
+		"logzio-url is not a valid http or https url: listener.logz.io:8071\n",
+		"logzio-attributes must be a JSON object",
+		"logzio-format must be one of text, json: xml\n",
+		"logzio-tag is not a valid template",
+		"logzio-backpressure must be one of",
+		"logzio-queue-max-size is not a valid size",
+		"env-regex is not a valid regexp",
+		"LOGZIO_RETRY_MAX_AGE is not a valid duration, e.g. 500ms or 2s: forever\n",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q in the error:\n%s", problem, err)
+		}
+	}
+	if lines := strings.Count(err.Error(), "\n"); lines != 9 {
+		t.Fatalf("Expected one line per problem, got %d:\n%s", lines, err)
+	}
+	os.Unsetenv(envRetryMaxAge)
+
+	_, err = validateDriverOpt(logger.Info{ContainerID: "123456789", Config: map[string]string{
+		logzioToken:   "",
+		logzioDirPath: "",
+		logzioTag:     "{{.Name}}/{{.ImageName}}",
+	}})
+	if err == nil || err.Error() != "logzio-token can't be empty\nlogzio-dir-path can't be empty\n" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
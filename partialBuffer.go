@@ -1,36 +1,116 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strconv"
+
 	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
 
 	"time"
 )
 
+const (
+	//log-opt
+	logzioOversize = "logzio-oversize"
+
+	envOversize = "LOGZIO_OVERSIZE"
+
+	// oversizeTruncate cuts a message at LOGZIO_MAX_MSG_BUFFER_SIZE
+	oversizeTruncate = "truncate"
+	// oversizeSplit sends a message in chunks of LOGZIO_MAX_MSG_BUFFER_SIZE
+	oversizeSplit = "split"
+
+	defaultOversize = oversizeTruncate
+
+	// the fields the partial buffer adds to the messages it cut or split
+	truncatedField    = "truncated"
+	originalSizeField = "original_size"
+	groupIDField      = "message_group_id"
+	chunkField        = "chunk"
+)
+
+// PartialBuffer joins the partial entries of a message. It is owned by the consumeLog goroutine of
+// the container, so it has no lock.
 type PartialBuffer struct {
-	buf       []byte
-	maxBytes  int
+	buf      []byte
+	maxBytes int
+	split    bool
+	// size is the size of the message, including the bytes that were cut
+	size      int
+	groupID   string
+	chunk     int
 	startTime time.Time
 	source    string
 	timeNano  int64
 	timeout   time.Duration
 }
 
-func (pb *PartialBuffer) Add(entry logdriver.LogEntry) {
-	if len(pb.buf) == 0 {
+// Add appends the line of entry, up to maxBytes. When over-size messages are split, it returns the
+// chunks that are full.
+func (pb *PartialBuffer) Add(entry logdriver.LogEntry) []*logger.Message {
+	if len(pb.buf) == 0 && pb.chunk == 0 {
 		pb.source = entry.Source
 		pb.timeNano = entry.TimeNano
 	}
+	pb.size += len(entry.Line)
+	var chunks []*logger.Message
 	line := entry.Line
-	sz := len(line)
-	//space left
-	space := pb.maxBytes - sz
+	for len(line) > 0 {
+		space := pb.maxBytes - len(pb.buf)
+		if space >= len(line) {
+			pb.buf = append(pb.buf, line...)
+			break
+		}
+		if space > 0 {
+			pb.buf = append(pb.buf, line[:space]...)
+			line = line[space:]
+		}
+		if !pb.split {
+			break
+		}
+		if pb.groupID == "" {
+			pb.groupID = newGroupID()
+		}
+		pb.chunk++
+		chunks = append(chunks, pb.newMessage(true, map[string]string{
+			groupIDField: pb.groupID,
+			chunkField:   strconv.Itoa(pb.chunk),
+		}))
+		pb.buf = nil
+	}
+	return chunks
+}
 
-	// do we have enough space?
-	if space > 0 {
-		if space > len(line) {
-			space = len(line)
+// message returns the buffered message with the source and time of its first entry. A message that
+// was cut has the truncated and original_size fields, the last chunk of a split message the group,
+// chunk and original_size fields.
+func (pb *PartialBuffer) message(partial bool) *logger.Message {
+	var attrs map[string]string
+	if pb.chunk > 0 {
+		attrs = map[string]string{
+			groupIDField:      pb.groupID,
+			chunkField:        strconv.Itoa(pb.chunk + 1),
+			originalSizeField: strconv.Itoa(pb.size),
 		}
-		pb.buf = append(pb.buf, line[:space]...)
+	} else if pb.size > len(pb.buf) {
+		attrs = map[string]string{
+			truncatedField:    "true",
+			originalSizeField: strconv.Itoa(pb.size),
+		}
+	}
+	return pb.newMessage(partial, attrs)
+}
+
+func (pb *PartialBuffer) newMessage(partial bool, attrs map[string]string) *logger.Message {
+	return &logger.Message{
+		Line:      pb.buf,
+		Source:    pb.source,
+		Timestamp: time.Unix(0, pb.timeNano),
+		Partial:   partial,
+		Attrs:     attrs,
 	}
 }
 
@@ -39,4 +119,199 @@ func (pb *PartialBuffer) Reset() {
 	pb.startTime = time.Now()
 	pb.timeNano = 0
 	pb.source = ""
+	pb.size = 0
+	pb.groupID = ""
+	pb.chunk = 0
+}
+
+func newGroupID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// reassembler joins the partial entries of a container into messages. The chunks of newer docker
+// versions are joined by the id and ordinal of their partial log metadata, the entries of older
+// versions by the Partial flag, in a buffer per stream. A message that doesn't finish is sent after
+// the buffer timeout.
+type reassembler struct {
+	maxBytes int
+	split    bool
+	timeout  time.Duration
+	buffers  map[string]*PartialBuffer
+	groups   map[string]*partialGroup
+	// expired keeps the groups that were sent after the timeout for another timeout, so their late
+	// chunks don't start a new message that waits for the chunks that were sent already
+	expired map[string]expiredGroup
+}
+
+// partialGroup joins the chunks of a partial log metadata id, the chunks that come before their
+// turn wait in pending
+type partialGroup struct {
+	*PartialBuffer
+	next    int32
+	pending map[int32]*logEntry
+}
+
+// expiredGroup is the last ordinal a group sent after the timeout had, and when it was sent
+type expiredGroup struct {
+	last int32
+	time time.Time
+}
+
+func newReassembler(maxBytes int, split bool, timeout time.Duration) *reassembler {
+	return &reassembler{
+		maxBytes: maxBytes,
+		split:    split,
+		timeout:  timeout,
+		buffers:  make(map[string]*PartialBuffer),
+		groups:   make(map[string]*partialGroup),
+		expired:  make(map[string]expiredGroup),
+	}
+}
+
+func (r *reassembler) newBuffer() *PartialBuffer {
+	return &PartialBuffer{maxBytes: r.maxBytes, split: r.split, timeout: r.timeout, startTime: time.Now()}
+}
+
+// add returns the messages that entry completes, and the chunks of the messages that are split
+func (r *reassembler) add(entry *logEntry) []*logger.Message {
+	if md := entry.PartialLogMetadata; md != nil && md.ID != "" {
+		return r.addChunk(entry, md)
+	}
+	// a line of stderr doesn't end the partial line of stdout
+	pb, ok := r.buffers[entry.Source]
+	if !ok {
+		pb = r.newBuffer()
+		r.buffers[entry.Source] = pb
+	}
+	msgs := pb.Add(entry.LogEntry)
+	if !entry.Partial || time.Now().Sub(pb.startTime) > r.timeout {
+		msgs = appendMessage(msgs, pb, entry.Partial)
+		delete(r.buffers, entry.Source)
+	}
+	return msgs
+}
+
+func (r *reassembler) addChunk(entry *logEntry, md *partialLogMetadata) []*logger.Message {
+	g, ok := r.groups[md.ID]
+	if !ok {
+		g = &partialGroup{PartialBuffer: r.newBuffer(), next: 1, pending: make(map[int32]*logEntry)}
+		if e, ok := r.expired[md.ID]; ok {
+			// the rest of a message that was sent after the timeout, the chunks that were sent are
+			// dropped and the late ones are joined from the first that comes
+			if md.Ordinal != 0 && md.Ordinal <= e.last {
+				return nil
+			}
+			g.next = e.last + 1
+			if md.Ordinal != 0 {
+				g.next = md.Ordinal
+			}
+		}
+		r.groups[md.ID] = g
+	}
+	ordinal := md.Ordinal
+	if ordinal == 0 {
+		// no ordinal, the chunks are joined as they come
+		ordinal = g.next
+	}
+	if ordinal < g.next {
+		// the chunk was joined already, or its message was sent after the timeout
+		return nil
+	}
+	g.pending[ordinal] = entry
+
+	var msgs []*logger.Message
+	for {
+		next, ok := g.pending[g.next]
+		if !ok {
+			return msgs
+		}
+		delete(g.pending, g.next)
+		g.next++
+		msgs = append(msgs, g.Add(next.LogEntry)...)
+		if next.PartialLogMetadata.Last {
+			delete(r.groups, md.ID)
+			if _, ok := r.expired[md.ID]; ok {
+				r.expired[md.ID] = expiredGroup{last: g.next - 1, time: time.Now()}
+			}
+			return appendMessage(msgs, g.PartialBuffer, false)
+		}
+	}
+}
+
+// expire returns the messages that didn't finish before the buffer timeout, or all of them
+func (r *reassembler) expire(now time.Time, all bool) []*logger.Message {
+	var msgs []*logger.Message
+	var sources []string
+	for source, pb := range r.buffers {
+		if all || !now.Before(pb.startTime.Add(r.timeout)) {
+			sources = append(sources, source)
+		}
+	}
+	sort.Slice(sources, func(i, j int) bool { return r.buffers[sources[i]].startTime.Before(r.buffers[sources[j]].startTime) })
+	for _, source := range sources {
+		msgs = appendMessage(msgs, r.buffers[source], true)
+		delete(r.buffers, source)
+	}
+	var ids []string
+	for id, g := range r.groups {
+		if all || !now.Before(g.startTime.Add(r.timeout)) {
+			ids = append(ids, id)
+		}
+	}
+	for id, e := range r.expired {
+		if !now.Before(e.time.Add(r.timeout)) {
+			delete(r.expired, id)
+		}
+	}
+	// the oldest message first
+	sort.Slice(ids, func(i, j int) bool { return r.groups[ids[i]].startTime.Before(r.groups[ids[j]].startTime) })
+	for _, id := range ids {
+		g := r.groups[id]
+		var ordinals []int
+		for ordinal := range g.pending {
+			ordinals = append(ordinals, int(ordinal))
+		}
+		sort.Ints(ordinals)
+		last := g.next - 1
+		// the chunks that were received are joined around the missing ones
+		for _, ordinal := range ordinals {
+			msgs = append(msgs, g.Add(g.pending[int32(ordinal)].LogEntry)...)
+			last = int32(ordinal)
+		}
+		msgs = appendMessage(msgs, g.PartialBuffer, true)
+		delete(r.groups, id)
+		r.expired[id] = expiredGroup{last: last, time: now}
+	}
+	return msgs
+}
+
+// deadline returns when the oldest unfinished message, or record of an expired one, expires
+func (r *reassembler) deadline() (time.Time, bool) {
+	var deadline time.Time
+	for _, pb := range r.buffers {
+		if d := pb.startTime.Add(r.timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	for _, g := range r.groups {
+		if d := g.startTime.Add(r.timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	for _, e := range r.expired {
+		if d := e.time.Add(r.timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// appendMessage appends the buffered message of pb, unless it is empty
+func appendMessage(msgs []*logger.Message, pb *PartialBuffer, partial bool) []*logger.Message {
+	if len(pb.buf) == 0 {
+		return msgs
+	}
+	return append(msgs, pb.message(partial))
 }
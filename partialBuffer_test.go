@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/plugins/logdriver"
+	"github.com/docker/docker/daemon/logger"
+	protoio "github.com/gogo/protobuf/io"
+)
+
+// consumeTest runs consumeLog on a pipe, the logs are dry-run and kept in a local copy to read them back
+type consumeTest struct {
+	lf   *ContainerLoggersCtx
+	w    *io.PipeWriter
+	enc  protoio.WriteCloser
+	done chan struct{}
+}
+
+func newConsumeTest(t *testing.T, dir string, name string, timeout time.Duration) *consumeTest {
+	info := logger.Info{
+		Config: map[string]string{logzioToken: "123", logzioDirPath: dir, logzioDryRun: "true",
+			logzioDryRunFile: filepath.Join(dir, name+".dry-run"), logzioLocalLog: localLogLocal},
+		ContainerID: name + "-containerid",
+		LogPath:     filepath.Join(dir, name+".log"),
+	}
+	logziol, err := newLogzioLogger(info, nil, hash("123", dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logziol.partialBufTimeout = timeout
+	localLogger, err := newLocalLogger(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, w := io.Pipe()
+	c := &consumeTest{
+		lf:   &ContainerLoggersCtx{info: info, localLogger: localLogger, logzioLogger: logziol, stream: r},
+		w:    w,
+		enc:  protoio.NewUint32DelimitedWriter(w, binary.BigEndian),
+		done: make(chan struct{}),
+	}
+	go func() {
+		consumeLog(c.lf)
+		close(c.done)
+	}()
+	return c
+}
+
+func (c *consumeTest) write(line string, partial bool) error {
+	return c.enc.WriteMsg(&logdriver.LogEntry{Source: "stdout", TimeNano: time.Now().UnixNano(), Line: []byte(line), Partial: partial})
+}
+
+// stop closes the FIFO and returns the lines the container logged
+func (c *consumeTest) stop(t *testing.T) []string {
+	c.w.Close()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumeLog did not return after the stream was closed")
+	}
+	c.lf.logzioLogger.Close()
+	return readLocalMessages(t, c.lf.localLogger, logger.ReadConfig{Tail: -1}, -1)
+}
+
+func partialTestDir(t *testing.T) string {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestConsumeLogPartialTimeout(t *testing.T) {
+	dir := partialTestDir(t)
+	defer os.RemoveAll(dir)
+	c := newConsumeTest(t, dir, "container", 50*time.Millisecond)
+
+	c.write("a", true)
+	c.write("b", true)
+	// the timer flushes the message without another entry
+	time.Sleep(200 * time.Millisecond)
+	c.write("c", true)
+	c.write("d", false)
+	c.write("e", false)
+	// the container stops in the middle of a message
+	c.write("f", true)
+	if lines := strings.Join(c.stop(t), ","); lines != "ab,cd,e,f" {
+		t.Fatalf("Unexpected lines: %s", lines)
+	}
+}
+
+// TestConsumeLogRace is meant for go test -race: containers log partial and complete messages with a
+// short flush timeout while the driver reads its maps, and are stopped while they still log
+func TestConsumeLogRace(t *testing.T) {
+	dir := partialTestDir(t)
+	defer os.RemoveAll(dir)
+	d := &Driver{
+		logs:    make(map[string]*ContainerLoggersCtx),
+		idx:     make(map[string]*ContainerLoggersCtx),
+		senders: make(map[string]*SenderConfigurations),
+	}
+	var tests []*consumeTest
+	for i := 0; i < 4; i++ {
+		c := newConsumeTest(t, dir, fmt.Sprintf("container%d", i), time.Millisecond)
+		d.logs[c.lf.info.ContainerID] = c.lf
+		d.idx[c.lf.info.ContainerID] = c.lf
+		tests = append(tests, c)
+	}
+
+	stop := make(chan struct{})
+	statusDone := make(chan struct{})
+	go func() {
+		defer close(statusDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				d.Status()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i, c := range tests {
+		wg.Add(1)
+		go func(c *consumeTest, stopEarly bool) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				if err := c.write(fmt.Sprintf("part-%d", j), j%3 != 2); err != nil {
+					return
+				}
+				if stopEarly && j == 100 {
+					go d.StopLogging(c.lf.info.ContainerID)
+				}
+			}
+			c.write("last", false)
+		}(c, i%2 == 1)
+	}
+	wg.Wait()
+	close(stop)
+	<-statusDone
+
+	for i, c := range tests {
+		d.StopLogging(c.lf.info.ContainerID)
+		lines := c.stop(t)
+		if i%2 == 0 && (len(lines) == 0 || !strings.HasSuffix(lines[len(lines)-1], "last")) {
+			t.Errorf("Expected every message of %s, got: %v", c.lf.info.ContainerID, lines)
+		}
+	}
+}
+
+func TestPartialBufferOversize(t *testing.T) {
+	entry := func(line string) logdriver.LogEntry {
+		return logdriver.LogEntry{Source: "stdout", Line: []byte(line), Partial: true}
+	}
+
+	pb := &PartialBuffer{maxBytes: 10}
+	for _, line := range []string{"0123", "4567", "89ab", "cdef"} {
+		if chunks := pb.Add(entry(line)); len(chunks) != 0 {
+			t.Fatalf("Truncate mode returned chunks: %v", chunks)
+		}
+	}
+	msg := pb.message(false)
+	if string(msg.Line) != "0123456789" || msg.Attrs[truncatedField] != "true" || msg.Attrs[originalSizeField] != "16" {
+		t.Fatalf("Unexpected truncated message: %q %v", msg.Line, msg.Attrs)
+	}
+	pb.Reset()
+	pb.Add(entry("0123456789"))
+	if msg := pb.message(false); string(msg.Line) != "0123456789" || len(msg.Attrs) != 0 {
+		t.Fatalf("A message of maxBytes is not truncated: %q %v", msg.Line, msg.Attrs)
+	}
+
+	pb = &PartialBuffer{maxBytes: 4, split: true}
+	chunks := pb.Add(entry("0123456789"))
+	chunks = append(chunks, pb.Add(entry("ab"))...)
+	chunks = append(chunks, pb.message(false))
+	var lines []string
+	for i, chunk := range chunks {
+		lines = append(lines, string(chunk.Line))
+		if chunk.Attrs[groupIDField] == "" || chunk.Attrs[groupIDField] != chunks[0].Attrs[groupIDField] {
+			t.Fatalf("Chunks don't share a group: %v", chunk.Attrs)
+		}
+		if chunk.Attrs[chunkField] != fmt.Sprint(i+1) || chunk.Partial != (i < len(chunks)-1) {
+			t.Fatalf("Unexpected chunk %d: %v partial: %v", i, chunk.Attrs, chunk.Partial)
+		}
+	}
+	if strings.Join(lines, ",") != "0123,4567,89ab" || chunks[2].Attrs[originalSizeField] != "12" {
+		t.Fatalf("Unexpected chunks: %v %v", lines, chunks[2].Attrs)
+	}
+}
+
+func TestConsumeLogTruncated(t *testing.T) {
+	dir := partialTestDir(t)
+	defer os.RemoveAll(dir)
+	os.Setenv(envMaxMsgBufferSize, "8")
+	defer os.Unsetenv(envMaxMsgBufferSize)
+	c := newConsumeTest(t, dir, "container", time.Second)
+	c.write("0123", true)
+	c.write("4567", true)
+	c.write("89", false)
+	c.write("short", false)
+	if lines := strings.Join(c.stop(t), ","); lines != "01234567,short" {
+		t.Fatalf("Unexpected lines: %s", lines)
+	}
+
+	data, err := ioutil.ReadFile(c.lf.info.Config[logzioDryRunFile])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var documents []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record struct {
+			Document map[string]interface{} `json:"document"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		documents = append(documents, record.Document)
+	}
+	if len(documents) != 2 || documents[0][truncatedField] != true || documents[0][originalSizeField] != float64(10) {
+		t.Fatalf("Expected the truncated fields in the first document: %v", documents)
+	}
+	if _, ok := documents[1][truncatedField]; ok {
+		t.Fatalf("Did not expect the truncated fields in the second document: %v", documents[1])
+	}
+}
+
+func (c *consumeTest) writeChunk(source string, line string, id string, ordinal int32, last bool) error {
+	return c.enc.WriteMsg(&logEntry{
+		LogEntry:           logdriver.LogEntry{Source: source, TimeNano: time.Now().UnixNano(), Line: []byte(line), Partial: true},
+		PartialLogMetadata: &partialLogMetadata{ID: id, Ordinal: ordinal, Last: last},
+	})
+}
+
+func TestLogEntryMetadata(t *testing.T) {
+	entry := &logEntry{
+		LogEntry:           logdriver.LogEntry{Source: "stderr", TimeNano: time.Now().UnixNano(), Line: []byte("chunk"), Partial: true},
+		PartialLogMetadata: &partialLogMetadata{ID: "abc", Ordinal: 300, Last: true},
+	}
+	data, err := entry.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded logEntry
+	if err := decoded.Unmarshal(data); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Source != entry.Source || decoded.TimeNano != entry.TimeNano || string(decoded.Line) != "chunk" ||
+		!decoded.Partial || *decoded.PartialLogMetadata != *entry.PartialLogMetadata {
+		t.Fatalf("Unexpected decoded entry: %+v %+v", decoded, decoded.PartialLogMetadata)
+	}
+
+	// the LogEntry of older docker versions skips the metadata
+	var old logdriver.LogEntry
+	if err := old.Unmarshal(data); err != nil || string(old.Line) != "chunk" {
+		t.Fatalf("Unexpected entry without metadata: %+v %v", old, err)
+	}
+	oldData, _ := old.Marshal()
+	if err := decoded.Unmarshal(oldData); err != nil || decoded.PartialLogMetadata != nil || string(decoded.Line) != "chunk" {
+		t.Fatalf("Unexpected entry of an older docker version: %+v %v", decoded, err)
+	}
+}
+
+func TestConsumeLogPartialMetadata(t *testing.T) {
+	dir := partialTestDir(t)
+	defer os.RemoveAll(dir)
+	// the timeout is longer than the test, the metadata ends the messages
+	c := newConsumeTest(t, dir, "container", time.Minute)
+
+	c.writeChunk("stdout", "out-1 ", "out", 1, false)
+	c.writeChunk("stderr", "err-1 ", "err", 1, false)
+	// out of order
+	c.writeChunk("stdout", "out-3", "out", 3, true)
+	c.writeChunk("stdout", "out-2 ", "out", 2, false)
+	c.write("complete", false)
+	// a chunk that was joined already
+	c.writeChunk("stderr", "err-1 ", "err", 1, false)
+	c.writeChunk("stderr", "err-2", "err", 2, true)
+	if lines := strings.Join(c.stop(t), ","); lines != "out-1 out-2 out-3,complete,err-1 err-2" {
+		t.Fatalf("Unexpected lines: %s", lines)
+	}
+}
+
+func TestConsumeLogPartialMetadataTimeout(t *testing.T) {
+	dir := partialTestDir(t)
+	defer os.RemoveAll(dir)
+	c := newConsumeTest(t, dir, "container", 50*time.Millisecond)
+
+	// the second chunk never comes
+	c.writeChunk("stdout", "a", "lost", 1, false)
+	c.writeChunk("stdout", "c", "lost", 3, true)
+	time.Sleep(200 * time.Millisecond)
+	c.writeChunk("stdout", "d", "next", 1, true)
+	if lines := strings.Join(c.stop(t), ","); lines != "ac,d" {
+		t.Fatalf("Unexpected lines: %s", lines)
+	}
+}
+
+func TestReassemblerLateChunks(t *testing.T) {
+	r := newReassembler(1024, false, time.Second)
+	chunk := func(line string, ordinal int32, last bool) []string {
+		var lines []string
+		for _, msg := range r.add(&logEntry{
+			LogEntry:           logdriver.LogEntry{Source: "stdout", Line: []byte(line)},
+			PartialLogMetadata: &partialLogMetadata{ID: "late", Ordinal: ordinal, Last: last},
+		}) {
+			lines = append(lines, string(msg.Line))
+		}
+		return lines
+	}
+
+	chunk("a", 1, false)
+	if msgs := r.expire(time.Now().Add(time.Second), false); len(msgs) != 1 || string(msgs[0].Line) != "a" {
+		t.Fatalf("Expected the first chunk after the timeout, got %v", msgs)
+	}
+	// the chunk that was sent is dropped, the late ones are joined without waiting for it
+	if lines := chunk("a", 1, false); lines != nil {
+		t.Fatalf("Expected the sent chunk to be dropped, got %v", lines)
+	}
+	chunk("b", 2, false)
+	if lines := chunk("c", 3, true); fmt.Sprint(lines) != "[bc]" {
+		t.Fatalf("Expected the late chunks at once, got %v", lines)
+	}
+	if lines := chunk("c", 3, true); lines != nil {
+		t.Fatalf("Expected the joined chunk to be dropped, got %v", lines)
+	}
+
+	// the record of the group expires with it, the id starts a new message after
+	if deadline, ok := r.deadline(); !ok || r.expire(deadline, false) != nil || len(r.expired) != 0 {
+		t.Fatal("Expected the record of the expired group to expire")
+	}
+	if _, ok := r.deadline(); ok {
+		t.Fatal("Expected no deadline once the record expired")
+	}
+	chunk("x", 1, false)
+	if lines := chunk("y", 2, true); fmt.Sprint(lines) != "[xy]" {
+		t.Fatalf("Expected a new message, got %v", lines)
+	}
+}
+
+func TestConsumeLogPartialStreams(t *testing.T) {
+	dir := partialTestDir(t)
+	defer os.RemoveAll(dir)
+	c := newConsumeTest(t, dir, "container", time.Minute)
+
+	// entries of older docker versions, without partial log metadata
+	entry := func(source string, line string, partial bool) {
+		if err := c.enc.WriteMsg(&logdriver.LogEntry{Source: source, TimeNano: time.Now().UnixNano(), Line: []byte(line), Partial: partial}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry("stdout", "out-1 ", true)
+	entry("stderr", "err-1 ", true)
+	entry("stdout", "out-2 ", true)
+	entry("stderr", "err-2", false)
+	entry("stderr", "err-line", false)
+	entry("stdout", "out-3", false)
+	// a partial line of each stream is left when the container stops
+	entry("stderr", "err-rest", true)
+	entry("stdout", "out-rest", true)
+
+	c.w.Close()
+	<-c.done
+	c.lf.logzioLogger.Close()
+	watcher := c.lf.localLogger.(logger.LogReader).ReadLogs(logger.ReadConfig{Tail: -1})
+	var lines []string
+	for msg := range watcher.Msg {
+		lines = append(lines, msg.Source+":"+strings.TrimSuffix(string(msg.Line), "\n"))
+	}
+	expected := "stderr:err-1 err-2,stderr:err-line,stdout:out-1 out-2 out-3,stderr:err-rest,stdout:out-rest"
+	if strings.Join(lines, ",") != expected {
+		t.Fatalf("Unexpected lines:\n%s\nexpected:\n%s", strings.Join(lines, ","), expected)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+const (
+	envConfigFile           = "LOGZIO_CONFIG_FILE"
+	envConfigReloadInterval = "LOGZIO_CONFIG_RELOAD_INTERVAL"
+
+	defaultConfigReloadInterval = time.Second * 10
+	defaultRedaction            = "[REDACTED]"
+)
+
+// pluginConfig is the plugin config file. Defaults are log-opts for the containers that don't set them,
+// the rules apply to the logs of every container in order filters, redact, routes,
+// and outputs are the extra senders that routes ship logs to.
+type pluginConfig struct {
+	Defaults map[string]string            `json:"defaults"`
+	Filters  []*logRule                   `json:"filters"`
+	Redact   []*logRule                   `json:"redact"`
+	Routes   []*logRule                   `json:"routes"`
+	Outputs  map[string]map[string]string `json:"outputs"`
+}
+
+// logRule selects logs by container name, stream and line, a selector that is not set matches every log
+type logRule struct {
+	Container string `json:"container"`
+	Source    string `json:"source"`
+	Match     string `json:"match"`
+	// Replace replaces the matches of a redact rule, it can refer to the groups of Match as $1
+	Replace string `json:"replace"`
+	// Output is the output of a route rule, with Copy the log is also shipped by the container's sender
+	Output string `json:"output"`
+	Copy   bool   `json:"copy"`
+
+	container *regexp.Regexp
+	match     *regexp.Regexp
+}
+
+func (r *logRule) matches(containerName string, source string, line []byte) bool {
+	if r.container != nil && !r.container.MatchString(containerName) {
+		return false
+	}
+	if r.Source != "" && r.Source != source {
+		return false
+	}
+	return r.match == nil || r.match.Match(line)
+}
+
+var (
+	configKeys = []string{"defaults", "filters", "redact", "routes", "outputs"}
+	ruleKeys   = map[string][]string{
+		"filters": {"container", "source", "match"},
+		"redact":  {"container", "source", "match", "replace"},
+		"routes":  {"container", "source", "match", "output", "copy"},
+	}
+)
+
+// parsePluginConfig parses and validates a JSON config file, it returns every problem of the file in one error
+func parsePluginConfig(data []byte) (*pluginConfig, error) {
+	var problems []string
+	// json.Decoder.DisallowUnknownFields is not available in go 1.9, the keys are checked by hand
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("config file is not valid JSON: %s\n", err)
+	}
+	problems = append(problems, unknownKeys("config file", raw, configKeys)...)
+	for _, section := range []string{"filters", "redact", "routes"} {
+		var rules []map[string]json.RawMessage
+		if err := json.Unmarshal(raw[section], &rules); err == nil {
+			for i, rule := range rules {
+				problems = append(problems, unknownKeys(fmt.Sprintf("%s[%d]", section, i), rule, ruleKeys[section])...)
+			}
+		}
+	}
+
+	config := &pluginConfig{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("config file is not valid: %s\n", err)
+	}
+
+	defaultProblems := checkOpts(logger.Info{Config: config.Defaults})
+	if len(defaultProblems) == 0 {
+		if err := validateOptValues(logger.Info{Config: config.Defaults}); err != nil {
+			defaultProblems = append(defaultProblems, err.Error())
+		}
+	}
+	// the problems of the defaults are not reported again for every output
+	reported := make(map[string]bool)
+	for _, problem := range defaultProblems {
+		reported[strings.TrimSpace(problem)] = true
+		problems = append(problems, fmt.Sprintf("defaults: %s", strings.TrimSpace(problem)))
+	}
+
+	for _, section := range []struct {
+		name  string
+		rules []*logRule
+	}{
+		{"filters", config.Filters},
+		{"redact", config.Redact},
+		{"routes", config.Routes},
+	} {
+		for i, rule := range section.rules {
+			where := fmt.Sprintf("%s[%d]", section.name, i)
+			if rule == nil {
+				problems = append(problems, fmt.Sprintf("%s: must be an object", where))
+				continue
+			}
+			problems = append(problems, rule.compile(where)...)
+			if section.name == "redact" && rule.Match == "" {
+				problems = append(problems, fmt.Sprintf("%s: match is required", where))
+			}
+			if section.name == "routes" {
+				if rule.Output == "" {
+					problems = append(problems, fmt.Sprintf("%s: output is required", where))
+				} else if _, ok := config.Outputs[rule.Output]; !ok {
+					problems = append(problems, fmt.Sprintf("%s: unknown output %s", where, rule.Output))
+				}
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(config.Outputs) {
+		where := fmt.Sprintf("outputs.%s", name)
+		if strings.TrimSpace(name) == "" {
+			problems = append(problems, "outputs: the output name can't be empty")
+		}
+		opts := config.outputConfig(name)
+		if _, err := validateDriverOpt(logger.Info{Config: opts}); err != nil {
+			for _, problem := range strings.Split(strings.TrimSpace(err.Error()), "\n") {
+				if !reported[problem] {
+					problems = append(problems, fmt.Sprintf("%s: %s", where, problem))
+				}
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid config file:\n  %s\n", strings.Join(problems, "\n  "))
+	}
+	return config, nil
+}
+
+func unknownKeys(where string, raw map[string]json.RawMessage, known []string) []string {
+	var problems []string
+	for _, key := range sortedKeys(raw) {
+		found := false
+		for _, k := range known {
+			if key == k {
+				found = true
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: unknown key %s, expected one of %s",
+				where, key, strings.Join(known, ", ")))
+		}
+	}
+	return problems
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *logRule) compile(where string) []string {
+	var problems []string
+	var err error
+	if r.Container != "" {
+		if r.container, err = regexp.Compile(r.Container); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: container is not a valid regexp: %s", where, err))
+		}
+	}
+	if r.Match != "" {
+		if r.match, err = regexp.Compile(r.Match); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: match is not a valid regexp: %s", where, err))
+		}
+	}
+	switch r.Source {
+	case "", "stdout", "stderr":
+	default:
+		problems = append(problems, fmt.Sprintf("%s: source must be stdout or stderr: %s", where, r.Source))
+	}
+	return problems
+}
+
+// outputConfig returns the log-opts of an output, the defaults it does not override included
+func (c *pluginConfig) outputConfig(name string) map[string]string {
+	return withDefaults(c.Outputs[name], c.Defaults)
+}
+
+// withDefaults returns a copy of config with the defaults it does not set
+func withDefaults(config map[string]string, defaults map[string]string) map[string]string {
+	merged := make(map[string]string, len(config)+len(defaults))
+	for key, value := range defaults {
+		merged[key] = value
+	}
+	for key, value := range config {
+		merged[key] = value
+	}
+	return merged
+}
+
+// pluginConfigs holds the loaded config file and the senders of its outputs
+var pluginConfigs = &configHolder{}
+
+type configHolder struct {
+	// reload serializes apply, which closes the replaced outputs without holding mu
+	reload  sync.Mutex
+	mu      sync.RWMutex
+	data    []byte
+	config  *pluginConfig
+	outputs map[string]*outputSender
+}
+
+// errOutputClosed is returned by the sends to an output that was closed by a reload
+var errOutputClosed = fmt.Errorf("the output was closed by a config reload")
+
+type outputSender struct {
+	config map[string]string
+	// mu is read locked by the sends, so the output is closed once they are done
+	mu     sync.RWMutex
+	closed bool
+	sender *shipper.LogzioSender
+}
+
+func (o *outputSender) send(data []byte) error {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.closed {
+		return errOutputClosed
+	}
+	return o.sender.Send(data)
+}
+
+// close waits for the sends in progress and closes the sender, with drain the queue is drained first
+func (o *outputSender) close(drain bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		return
+	}
+	o.closed = true
+	if drain {
+		o.sender.Stop()
+	} else {
+		o.sender.Close()
+	}
+}
+
+// load reads the config file at path and applies it when it changed, an empty path removes the config.
+// An invalid config is rejected and the current config stays in use.
+func (h *configHolder) load(path string) error {
+	var data []byte
+	var config *pluginConfig
+	if path != "" {
+		var err error
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return fmt.Errorf("failed to read %s: %s\n", envConfigFile, err)
+		}
+		h.mu.RLock()
+		unchanged := h.config != nil && string(data) == string(h.data)
+		h.mu.RUnlock()
+		if unchanged {
+			return nil
+		}
+		if config, err = parsePluginConfig(data); err != nil {
+			return fmt.Errorf("%s %s", path, err)
+		}
+	}
+	return h.apply(config, data)
+}
+
+// apply replaces the config and the outputs whose options changed. The outputs are closed and created
+// without holding mu, so the containers keep logging meanwhile, and the logs routed to an output that is
+// being replaced are shipped by the container's sender.
+func (h *configHolder) apply(config *pluginConfig, data []byte) error {
+	h.reload.Lock()
+	defer h.reload.Unlock()
+	h.mu.RLock()
+	old := make(map[string]*outputSender, len(h.outputs))
+	for name, o := range h.outputs {
+		old[name] = o
+	}
+	h.mu.RUnlock()
+	outputs := make(map[string]*outputSender)
+	replaced := make(map[string]*outputSender)
+	var created []*shipper.LogzioSender
+	var err error
+	if config != nil {
+		for name := range config.Outputs {
+			opts := config.outputConfig(name)
+			if o, ok := old[name]; ok && reflect.DeepEqual(o.config, opts) {
+				outputs[name] = o
+				continue
+			}
+			if o, ok := old[name]; ok {
+				// the new sender takes over the queue of the output, the logs in it are not lost
+				o.close(false)
+				delete(old, name)
+				replaced[name] = o
+			}
+			var sender *shipper.LogzioSender
+			if sender, err = newOutputSender(name, opts); err != nil {
+				err = fmt.Errorf("failed to create output %s: %s\n", name, strings.TrimSpace(err.Error()))
+				break
+			}
+			created = append(created, sender)
+			outputs[name] = &outputSender{config: opts, sender: sender}
+		}
+	}
+	if err != nil {
+		for _, sender := range created {
+			sender.Close()
+		}
+		// reopen the outputs that were replaced, the routes of an output that can't be reopened
+		// fall back to the sender of the container
+		for name, o := range replaced {
+			sender, reopenErr := newOutputSender(name, o.config)
+			if reopenErr != nil {
+				logrus.WithField("output", name).WithError(reopenErr).
+					Error("Logz.io: the output could not be reopened, its routes are shipped by the senders of the containers")
+				continue
+			}
+			old[name] = &outputSender{config: o.config, sender: sender}
+		}
+		h.mu.Lock()
+		h.outputs = old
+		h.mu.Unlock()
+		return err
+	}
+	h.mu.Lock()
+	h.config = config
+	h.data = data
+	h.outputs = outputs
+	h.mu.Unlock()
+
+	for name, o := range old {
+		if _, ok := outputs[name]; !ok {
+			o.close(true)
+		}
+	}
+	if config != nil {
+		logrus.WithField("outputs", sortedKeys(outputs)).Info("Logz.io: loaded the config file")
+	}
+	return nil
+}
+
+func newOutputSender(name string, opts map[string]string) (*shipper.LogzioSender, error) {
+	info := logger.Info{Config: opts}
+	token, err := getToken(info)
+	if err != nil {
+		return nil, err
+	}
+	return newLogzioSender(info, token, nil, hash(name, token, opts[logzioDirPath]))
+}
+
+// isOutputQueue reports whether queue under dir is the queue of an output of the config file
+func (h *configHolder) isOutputQueue(dir string, queue string) bool {
+	// the token of an output can be read from a file, it is not done under the lock the logs are routed with
+	configs := make(map[string]map[string]string)
+	h.mu.RLock()
+	for name, o := range h.outputs {
+		if o.config[logzioDirPath] == dir {
+			configs[name] = o.config
+		}
+	}
+	h.mu.RUnlock()
+	for name, config := range configs {
+		token, err := getToken(logger.Info{Config: config})
+		if err == nil && hash(name, token, dir) == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the config file at path every LOGZIO_CONFIG_RELOAD_INTERVAL
+func (h *configHolder) watch(path string) {
+	interval := getEnvDuration(envConfigReloadInterval, defaultConfigReloadInterval)
+	for {
+		time.Sleep(interval)
+		if err := h.load(path); err != nil {
+			logrus.WithError(err).Error("Logz.io: the config file was not reloaded, keeping the current config")
+		}
+	}
+}
+
+// withDefaults returns a copy of the log-opts of a container with the defaults of the config file it does not set
+func (h *configHolder) withDefaults(config map[string]string) map[string]string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.config == nil {
+		return config
+	}
+	return withDefaults(config, h.config.Defaults)
+}
+
+// filter drops the line when a filter matches it, and redacts it otherwise
+func (h *configHolder) filter(containerName string, source string, line []byte) ([]byte, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.config == nil {
+		return line, true
+	}
+	for _, rule := range h.config.Filters {
+		if rule.matches(containerName, source, line) {
+			return nil, false
+		}
+	}
+	for _, rule := range h.config.Redact {
+		if rule.container != nil && !rule.container.MatchString(containerName) ||
+			rule.Source != "" && rule.Source != source {
+			continue
+		}
+		replace := rule.Replace
+		if replace == "" {
+			replace = defaultRedaction
+		}
+		line = rule.match.ReplaceAll(line, []byte(replace))
+	}
+	return line, true
+}
+
+// route ships the message to the output of the first route that matches the line, or writes it to the
+// dry-run file of the logger. It returns whether the container's sender should ship the message too.
+func (h *configHolder) route(logzioLogger *LogzioLogger, source string, line []byte, doc *logDocument) bool {
+	rule, output := h.matchRoute(logzioLogger.containerName, source, line)
+	if output == nil {
+		return true
+	}
+	// the output is used without the lock, so a stalled output only holds up the logs routed to it
+	buf := getBuffer()
+	defer putBuffer(buf)
+	logzioLogger.encoder.encode(buf, doc)
+	if logzioLogger.dryRun != nil {
+		if err := logzioLogger.dryRun.write(logzioLogger.containerID, rule.Output, buf.Bytes()); err != nil {
+			logrus.WithField("output", rule.Output).Error(fmt.Sprintf("Error writing the dry run: %s\n", err))
+		}
+		return rule.Copy
+	}
+	if err := output.send(buf.Bytes()); err == errOutputClosed {
+		return true
+	} else if err != nil {
+		logrus.WithField("output", rule.Output).Error(fmt.Sprintf("Error enqueue object: %s\n", err))
+	}
+	return rule.Copy
+}
+
+// matchRoute returns the first route that matches the line and its output, a nil output when none matches
+func (h *configHolder) matchRoute(containerName string, source string, line []byte) (*logRule, *outputSender) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.config == nil {
+		return nil, nil
+	}
+	for _, rule := range h.config.Routes {
+		if rule.matches(containerName, source, line) {
+			return rule, h.outputs[rule.Output]
+		}
+	}
+	return nil, nil
+}
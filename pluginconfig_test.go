@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+)
+
+// recordingListener keeps the messages of every bulk it receives
+type recordingListener struct {
+	*httptest.Server
+	mu       sync.Mutex
+	messages []string
+}
+
+func newRecordingListener() *recordingListener {
+	l := &recordingListener{}
+	l.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			l.messages = append(l.messages, line)
+		}
+	}))
+	return l
+}
+
+func (l *recordingListener) Messages() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(l.messages, "\n")
+}
+
+func TestPluginConfigValidation(t *testing.T) {
+	_, err := parsePluginConfig([]byte(`{
+		"defaults": {"logzio-format": "json", "logzio-colour": "red", "logzio-retry-max-attempts": "many"},
+		"filters": [{"match": "(unclosed"}, {"source": "stdin"}],
+		"redact": [{"replace": "xxx"}],
+		"routes": [{"match": "error", "output": "missing"}, {"match": "warn", "outptu": "warnings"}],
+		"outputs": {"warnings": {"logzio-token": "123"}},
+		"output": {}
+	}`))
+	if err == nil {
+		t.Fatal("Expected the config to be rejected")
+	}
+	for _, problem := range []string{
+		"config file: unknown key output",
+		"defaults: wrong log-opt: 'logzio-colour'",
+		"defaults: logzio-retry-max-attempts",
+		"filters[0]: match is not a valid regexp",
+		"filters[1]: source must be stdout or stderr: stdin",
+		"redact[0]: match is required",
+		"routes[0]: unknown output missing",
+		"routes[1]: unknown key outptu",
+		"routes[1]: output is required",
+		"outputs.warnings: logz.io dir path is required",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q in the error:\n%s", problem, err)
+		}
+	}
+
+	if _, err := parsePluginConfig([]byte(`{"defaults": `)); err == nil {
+		t.Fatal("Expected a config that is not JSON to be rejected")
+	}
+	config, err := parsePluginConfig([]byte(`{
+		"defaults": {"logzio-type": "app"},
+		"routes": [{"container": "^web", "source": "stderr", "output": "errors", "copy": true}],
+		"outputs": {"errors": {"logzio-token": "123", "logzio-dir-path": "./out"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts := config.outputConfig("errors"); opts[logzioType] != "app" || opts[logzioToken] != "123" {
+		t.Fatalf("Output does not use the defaults: %v", opts)
+	}
+}
+
+func TestPluginConfigReload(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	main, errs, errs2 := newRecordingListener(), newRecordingListener(), newRecordingListener()
+	defer main.Close()
+	defer errs.Close()
+	defer errs2.Close()
+
+	configFile := writeTestFile(t, dir, "config.json", []byte(fmt.Sprintf(`{
+		"defaults": {"logzio-type": "fromconfig", "logzio-url": %q},
+		"filters": [{"match": "healthcheck"}],
+		"redact": [{"match": "password=\\S+", "replace": "password=xxx"}],
+		"routes": [{"container": "^web$", "match": "level=error", "output": "errors"}],
+		"outputs": {"errors": {"logzio-url": %q, "logzio-token": "errToken", "logzio-dir-path": %q}}
+	}`, main.URL, errs.URL, dir)))
+	if err := pluginConfigs.load(configFile); err != nil {
+		t.Fatal(err)
+	}
+	defer pluginConfigs.load("")
+
+	info := logger.Info{
+		Config:        map[string]string{logzioToken: "123", logzioDirPath: dir},
+		ContainerID:   "containeriid",
+		ContainerName: "/web",
+	}
+	info.Config = pluginConfigs.withDefaults(info.Config)
+	if info.Config[logzioURL] != main.URL || info.Config[logzioToken] != "123" {
+		t.Fatalf("Defaults were not applied: %v", info.Config)
+	}
+	hashCode, err := validateDriverOpt(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logziol, err := newLogzioLogger(info, nil, hashCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logLines := func(lines ...string) {
+		for _, line := range lines {
+			if err := logziol.Log(&logger.Message{Line: []byte(line), Source: "stdout", Timestamp: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	logLines("healthcheck ok", "login password=hunter2", "level=error first")
+	pluginConfigs.outputs["errors"].sender.Drain()
+	logLines("level=error second")
+
+	// the output moves to another listener and the routes copy the logs to the container's sender
+	writeTestFile(t, dir, "config.json", []byte(fmt.Sprintf(`{
+		"defaults": {"logzio-type": "fromconfig", "logzio-url": %q},
+		"routes": [{"match": "level=error", "output": "errors", "copy": true}],
+		"outputs": {"errors": {"logzio-url": %q, "logzio-token": "errToken", "logzio-dir-path": %q}}
+	}`, main.URL, errs2.URL, dir)))
+	if err := pluginConfigs.load(configFile); err != nil {
+		t.Fatal(err)
+	}
+	logLines("healthcheck again", "level=error third")
+
+	writeTestFile(t, dir, "config.json", []byte(`{"filters": [{"match": "("}]}`))
+	if err := pluginConfigs.load(configFile); err == nil || !strings.Contains(err.Error(), "filters[0]") {
+		t.Fatalf("Expected the invalid config to be rejected: %v", err)
+	}
+	logLines("level=error fourth")
+	pluginConfigs.outputs["errors"].sender.Drain()
+	if err := logziol.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		listener *recordingListener
+		expected []string
+		missing  []string
+	}{
+		{main, []string{"login password=xxx", `"type":"fromconfig"`, "healthcheck again", "level=error third", "level=error fourth"},
+			[]string{"hunter2", "healthcheck ok", "level=error first", "level=error second"}},
+		{errs, []string{"level=error first"}, []string{"level=error second"}},
+		{errs2, []string{"level=error second", "level=error third", "level=error fourth"}, []string{"level=error first"}},
+	} {
+		messages := c.listener.Messages()
+		for _, expected := range c.expected {
+			if !strings.Contains(messages, expected) {
+				t.Errorf("Expected %q in:\n%s", expected, messages)
+			}
+		}
+		for _, missing := range c.missing {
+			if strings.Contains(messages, missing) {
+				t.Errorf("Did not expect %q in:\n%s", missing, messages)
+			}
+		}
+	}
+}
+
+func TestStalledOutputDoesNotBlockLogging(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener := newRecordingListener()
+	defer listener.Close()
+	config := `{
+		"routes": [{"match": "slow", "output": "slow"}],
+		"outputs": {"slow": {"logzio-url": %q, "logzio-token": "slowToken", "logzio-dir-path": %q, "logzio-type": %q}}
+	}`
+	configFile := writeTestFile(t, dir, "config.json", []byte(fmt.Sprintf(config, listener.URL, dir, "first")))
+	if err := pluginConfigs.load(configFile); err != nil {
+		t.Fatal(err)
+	}
+	defer pluginConfigs.load("")
+
+	// a send to the output that does not return
+	slow := pluginConfigs.outputs["slow"]
+	slow.mu.RLock()
+	writeTestFile(t, dir, "config.json", []byte(fmt.Sprintf(config, listener.URL, dir, "second")))
+	reloaded := make(chan error, 1)
+	go func() {
+		reloaded <- pluginConfigs.load(configFile)
+	}()
+
+	// the other logs are filtered and routed while the reload waits for the send
+	logged := make(chan struct{})
+	go func() {
+		pluginConfigs.filter("/web", "stdout", []byte("fast"))
+		pluginConfigs.matchRoute("/web", "stdout", []byte("fast"))
+		close(logged)
+	}()
+	select {
+	case <-logged:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Logging is blocked by a stalled output")
+	}
+	select {
+	case err := <-reloaded:
+		t.Fatalf("The reload did not wait for the send: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	slow.mu.RUnlock()
+	if err := <-reloaded; err != nil {
+		t.Fatal(err)
+	}
+	if !slow.closed || pluginConfigs.outputs["slow"] == slow {
+		t.Fatal("Expected the replaced output to be closed after the send")
+	}
+}
+
+func TestPluginConfigReopenFailureIsLogged(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	queueDir := filepath.Join(dir, "queues")
+	if err := os.MkdirAll(queueDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := `{
+		"routes": [{"match": "level=error", "output": "errors"}],
+		"outputs": {"errors": {"logzio-token": "errToken", "logzio-dir-path": %q, "logzio-type": %q}}
+	}`
+	configFile := writeTestFile(t, dir, "config.json", []byte(fmt.Sprintf(config, queueDir, "first")))
+	if err := pluginConfigs.load(configFile); err != nil {
+		t.Fatal(err)
+	}
+	defer pluginConfigs.load("")
+
+	// the queue dir of the output is replaced by a file, neither the new output nor the old one can be opened
+	if err := os.RemoveAll(queueDir); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "queues", []byte("not a dir"))
+	writeTestFile(t, dir, "config.json", []byte(fmt.Sprintf(config, queueDir, "second")))
+	var logs bytes.Buffer
+	logrus.SetOutput(&logs)
+	defer logrus.SetOutput(os.Stderr)
+	if err := pluginConfigs.load(configFile); err == nil {
+		t.Fatal("Expected the reload to fail")
+	}
+	if _, output := pluginConfigs.matchRoute("/web", "stdout", []byte("level=error")); output != nil {
+		t.Fatal("Expected the route to have no output")
+	}
+	if !strings.Contains(logs.String(), "the output could not be reopened") || !strings.Contains(logs.String(), "output=errors") {
+		t.Fatalf("Expected the output that was not reopened to be logged, got %s", logs.String())
+	}
+}
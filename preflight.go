@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+const (
+	//log-opt
+	logzioPreflight = "logzio-preflight"
+
+	envPreflight    = "LOGZIO_PREFLIGHT"
+	envPreflightTTL = "LOGZIO_PREFLIGHT_TTL"
+
+	// preflightOff does not check the listener when the container starts
+	preflightOff = "false"
+	// preflightFail fails the container start when the listener is unreachable or rejects the token
+	preflightFail = "true"
+	// preflightWarn logs a warning instead, the logs wait in the disk queue
+	preflightWarn = "warn"
+
+	defaultPreflightTTL = time.Minute * 5
+)
+
+// getPreflight returns whether the listener is checked when the container starts, and what a failure does
+func getPreflight(loggerInfo logger.Info) (string, error) {
+	mode := getOptOrEnv(loggerInfo, logzioPreflight, envPreflight)
+	switch mode {
+	case "":
+		return preflightOff, nil
+	case preflightOff, preflightFail, preflightWarn:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%s must be one of %s, %s or %s: %s\n", logzioPreflight,
+			preflightOff, preflightFail, preflightWarn, mode)
+	}
+}
+
+// checkPreflight checks that the listener of the sender is reachable and accepts its token.
+// The senders cache the result for LOGZIO_PREFLIGHT_TTL, so containers sharing a token check it once.
+func checkPreflight(loggerInfo logger.Info, sender *shipper.LogzioSender) error {
+	mode, err := getPreflight(loggerInfo)
+	if err != nil || mode == preflightOff {
+		return err
+	}
+	if err := sender.Preflight(getEnvDuration(envPreflightTTL, defaultPreflightTTL)); err != nil {
+		if mode == preflightWarn {
+			logrus.WithField("id", loggerInfo.ContainerID).WithError(err).
+				Warn("Logz.io: preflight check failed, the logs are kept in the disk queue")
+			return nil
+		}
+		return fmt.Errorf("preflight check failed: %s\n", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+func TestPreflight(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Query().Get("token") != "goodToken" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	sender, err := shipper.New("badToken", shipper.SetUrl(ts.URL), shipper.SetTempDirectory(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Stop()
+	info := func(mode string) logger.Info {
+		return logger.Info{ContainerID: "containeriid", Config: map[string]string{logzioPreflight: mode}}
+	}
+
+	if err := checkPreflight(logger.Info{}, sender); err != nil || atomic.LoadInt32(&requests) != 0 {
+		t.Fatalf("Expected no preflight by default: %v", err)
+	}
+	err = checkPreflight(info(preflightFail), sender)
+	if err == nil || !strings.Contains(err.Error(), "rejected the token") || strings.Contains(err.Error(), "badToken") {
+		t.Fatalf("Expected the token to be rejected: %v", err)
+	}
+	if err := checkPreflight(info(preflightFail), sender); err == nil || atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("Expected the cached result, %d requests: %v", atomic.LoadInt32(&requests), err)
+	}
+	if err := checkPreflight(info(preflightWarn), sender); err != nil {
+		t.Fatalf("Expected only a warning: %v", err)
+	}
+
+	// a rotated token is checked again
+	sender.SetToken("goodToken")
+	if err := checkPreflight(info(preflightFail), sender); err != nil || atomic.LoadInt32(&requests) != 2 {
+		t.Fatalf("Expected the new token to be accepted: %v", err)
+	}
+
+	unreachable, err := shipper.New("goodToken", shipper.SetUrl("http://localhost:1"),
+		shipper.SetTempDirectory(dir+"/unreachable"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unreachable.Stop()
+	if err := checkPreflight(info(preflightFail), unreachable); err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Fatalf("Expected the listener to be unreachable: %v", err)
+	}
+
+	if _, err := validateDriverOpt(logger.Info{Config: map[string]string{
+		logzioToken: "goodToken", logzioDirPath: dir, logzioPreflight: "yes"}}); err == nil {
+		t.Fatal("Expected an error for an unknown preflight mode")
+	}
+}
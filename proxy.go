@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	//log-opt
+	logzioProxy   = "logzio-proxy"
+	logzioNoProxy = "logzio-no-proxy"
+
+	envHTTPSProxy = "LOGZIO_HTTPS_PROXY"
+	envNoProxy    = "LOGZIO_NO_PROXY"
+
+	maskedValue = "xxxxx"
+)
+
+// getProxy returns the proxy function of the sender's transport, or nil when no proxy is configured
+// and the plugin environment (HTTPS_PROXY, NO_PROXY) applies as before.
+func getProxy(loggerInfo logger.Info) (func(*http.Request) (*url.URL, error), error) {
+	proxyStr := getOptOrEnv(loggerInfo, logzioProxy, envHTTPSProxy)
+	if proxyStr == "" {
+		return nil, nil
+	}
+	proxyURL, err := url.Parse(proxyStr)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("%s is not a valid proxy url: %s\n", logzioProxy, maskURL(proxyStr))
+	}
+	// https proxies are not supported by the net/http of the go version the plugin is built with
+	if proxyURL.Scheme != "http" {
+		return nil, fmt.Errorf("%s scheme must be http: %s\n", logzioProxy, maskURL(proxyStr))
+	}
+	noProxy := parseNoProxy(getOptOrEnv(loggerInfo, logzioNoProxy, envNoProxy))
+
+	return func(req *http.Request) (*url.URL, error) {
+		if useProxy(req.URL.Hostname(), noProxy) {
+			return proxyURL, nil
+		}
+		return nil, nil
+	}, nil
+}
+
+func parseNoProxy(noProxyStr string) []string {
+	var noProxy []string
+	for _, entry := range strings.Split(noProxyStr, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" {
+			noProxy = append(noProxy, entry)
+		}
+	}
+	return noProxy
+}
+
+// useProxy reports whether host is not matched by one of the no-proxy entries.
+// An entry is either "*", an IP, a CIDR or a domain which also matches its subdomains.
+func useProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		if entry == "*" {
+			return false
+		}
+		if ip != nil {
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return false
+			}
+			if entryIP := net.ParseIP(entry); entryIP != nil && entryIP.Equal(ip) {
+				return false
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entry, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// maskURL hides the password of a url so it can be logged
+func maskURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return maskedValue
+	}
+	if u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), maskedValue)
+	}
+	return u.String()
+}
+
+// maskConfig returns a copy of the log-opts that is safe to log
+func maskConfig(config map[string]string) map[string]string {
+	masked := make(map[string]string, len(config))
+	for key, value := range config {
+		masked[key] = value
+	}
+	if proxy, ok := masked[logzioProxy]; ok {
+		masked[logzioProxy] = maskURL(proxy)
+	}
+	if _, ok := masked[logzioToken]; ok {
+		masked[logzioToken] = maskedValue
+	}
+	return masked
+}
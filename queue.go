@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beeker1121/goque"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+// queueRecord is a record of a disk queue, Plain is nil when it can't be decrypted
+type queueRecord struct {
+	Plain []byte
+	Err   error
+}
+
+// queueStats summarizes a disk queue
+type queueStats struct {
+	Records    int
+	Bytes      int64
+	Largest    int
+	Encrypted  int
+	Unreadable int
+	Oldest     time.Time
+	Newest     time.Time
+	DiskBytes  int64
+}
+
+// queueCommand inspects, purges and replays the disk queues under a logzio-dir-path.
+// The plugin holds a lock on the queues of running containers, so they are read once the plugin is disabled.
+func queueCommand(args []string, out io.Writer) error {
+	usage := "usage: queue ls|stat|dump|purge|replay --dir <logzio-dir-path> [--hash <queue>] [--key-file <path>] " +
+		"[--limit <n>] [--url <url> --token <token> [--purge]]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	flags := flag.NewFlagSet("queue "+args[0], flag.ContinueOnError)
+	dir := flags.String("dir", "", "logzio-dir-path of the containers")
+	hashCode := flags.String("hash", "", "only this queue, all queues when empty")
+	keyFile := flags.String("key-file", "", "encryption keys of the records, defaults to "+envEncryptionKeyFile+" or "+envEncryptionKey)
+	limit := flags.Int("limit", 0, "dump at most this many records of every queue, 0 dumps all")
+	urlStr := flags.String("url", "", "listener url to replay to")
+	token := flags.String("token", "", "token to replay with")
+	purge := flags.Bool("purge", false, "purge the queue once it was replayed")
+	all := flags.Bool("all", false, "purge all the queues when --hash is not set")
+	debug := flags.Bool("debug", false, "print the sender debug logs")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New(usage)
+	}
+	keyring, err := getKeyring(logger.Info{Config: keyFileConfig(*keyFile)})
+	if err != nil {
+		return err
+	}
+	queues, err := diskQueues(*dir, *hashCode)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "ls":
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "QUEUE\tRECORDS\tBYTES\tOLDEST")
+		for _, queue := range queues {
+			stats, err := readQueue(filepath.Join(*dir, queue), keyring, nil)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", queue, stats.Records, stats.Bytes, age(stats.Oldest))
+		}
+		return w.Flush()
+	case "stat":
+		for i, queue := range queues {
+			stats, err := readQueue(filepath.Join(*dir, queue), keyring, nil)
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				fmt.Fprintln(out)
+			}
+			w := tabwriter.NewWriter(out, 0, 8, 1, ' ', 0)
+			fmt.Fprintf(w, "queue:\t%s\n", queue)
+			fmt.Fprintf(w, "records:\t%d\n", stats.Records)
+			fmt.Fprintf(w, "bytes:\t%d\n", stats.Bytes)
+			fmt.Fprintf(w, "disk bytes:\t%d\n", stats.DiskBytes)
+			fmt.Fprintf(w, "largest record:\t%d\n", stats.Largest)
+			fmt.Fprintf(w, "encrypted:\t%d\n", stats.Encrypted)
+			fmt.Fprintf(w, "unreadable:\t%d\n", stats.Unreadable)
+			fmt.Fprintf(w, "oldest:\t%s\n", timestamp(stats.Oldest))
+			fmt.Fprintf(w, "newest:\t%s\n", timestamp(stats.Newest))
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "dump":
+		for _, queue := range queues {
+			var dumped int
+			var recordErr error
+			_, err := readQueue(filepath.Join(*dir, queue), keyring, func(record queueRecord) bool {
+				if record.Err != nil {
+					recordErr = fmt.Errorf("%s: record %d: %s", queue, dumped, record.Err)
+					return false
+				}
+				fmt.Fprintf(out, "%s\n", record.Plain)
+				dumped++
+				return *limit <= 0 || dumped < *limit
+			})
+			if err != nil {
+				return err
+			}
+			if recordErr != nil {
+				return recordErr
+			}
+		}
+		return nil
+	case "purge":
+		if *hashCode == "" && !*all {
+			return errors.New("purge requires --hash, or --all to purge every queue")
+		}
+		for _, queue := range queues {
+			if err := purgeQueue(filepath.Join(*dir, queue)); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "%s: purged\n", queue)
+		}
+		return nil
+	case "replay":
+		if *urlStr == "" || *token == "" {
+			return errors.New("replay requires --url and --token")
+		}
+		tmpDir, err := ioutil.TempDir("", "logzio-replay")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpDir)
+		var debugWriter io.Writer
+		if *debug {
+			debugWriter = os.Stderr
+		}
+		for _, queue := range queues {
+			var docs [][]byte
+			stats, err := readQueue(filepath.Join(*dir, queue), keyring, func(record queueRecord) bool {
+				docs = append(docs, record.Plain)
+				return true
+			})
+			if err != nil {
+				return err
+			}
+			if stats.Unreadable > 0 {
+				return fmt.Errorf("%s: %d records can't be decrypted, set --key-file", queue, stats.Unreadable)
+			}
+			// rejected batches go to the dead-letter queue of the queue
+			sender, err := shipper.New(*token,
+				shipper.SetUrl(*urlStr),
+				shipper.SetDebug(debugWriter),
+				shipper.SetTempDirectory(filepath.Join(tmpDir, queue)),
+				shipper.SetDeadLetterDirectory(deadLetterDir(*dir, queue)),
+				shipper.SetKeyring(keyring))
+			if err != nil {
+				return err
+			}
+			replayed, err := sender.Replay(docs)
+			sender.Stop()
+			fmt.Fprintf(out, "%s: replayed %d of %d records\n", queue, replayed, stats.Records)
+			if err != nil {
+				return err
+			}
+			if *purge {
+				if err := purgeQueue(filepath.Join(*dir, queue)); err != nil {
+					return err
+				}
+				fmt.Fprintf(out, "%s: purged\n", queue)
+			}
+		}
+		return nil
+	default:
+		return errors.New(usage)
+	}
+}
+
+// diskQueues returns the queue dirs newLogzioSender created under dir
+func diskQueues(dir string, hashCode string) ([]string, error) {
+	if hashCode != "" {
+		if !isDiskQueue(filepath.Join(dir, hashCode)) {
+			return nil, fmt.Errorf("no queue %s in %s", hashCode, dir)
+		}
+		return []string{hashCode}, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var queues []string
+	for _, f := range files {
+		if f.IsDir() && f.Name() != deadLetterDirName && isDiskQueue(filepath.Join(dir, f.Name())) {
+			queues = append(queues, f.Name())
+		}
+	}
+	return queues, nil
+}
+
+// isDiskQueue reports whether path holds a goque queue, a LevelDB dir
+func isDiskQueue(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "CURRENT"))
+	return err == nil
+}
+
+func openDiskQueue(path string) (*goque.Queue, error) {
+	q, err := goque.OpenQueue(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open queue %s, the plugin locks the queues of running containers: %s", path, err)
+	}
+	return q, nil
+}
+
+// readQueue peeks the records of the queue at path one by one without removing them,
+// and passes every record to fn until it returns false. The stats only count the records read.
+func readQueue(path string, keyring *shipper.Keyring, fn func(queueRecord) bool) (*queueStats, error) {
+	q, err := openDiskQueue(path)
+	if err != nil {
+		return nil, err
+	}
+	defer q.Close()
+
+	stats := &queueStats{}
+	for i := uint64(0); i < q.Length(); i++ {
+		item, err := q.PeekByOffset(i)
+		if err != nil {
+			return nil, err
+		}
+		var record queueRecord
+		stats.Records++
+		stats.Bytes += int64(len(item.Value))
+		if len(item.Value) > stats.Largest {
+			stats.Largest = len(item.Value)
+		}
+		if shipper.IsSealed(item.Value) {
+			stats.Encrypted++
+		}
+		if record.Plain, record.Err = keyring.Open(item.Value); record.Err != nil {
+			stats.Unreadable++
+		} else {
+			if t := recordTime(record.Plain); !t.IsZero() {
+				if stats.Oldest.IsZero() || t.Before(stats.Oldest) {
+					stats.Oldest = t
+				}
+				if t.After(stats.Newest) {
+					stats.Newest = t
+				}
+			}
+		}
+		if fn != nil && !fn(record) {
+			break
+		}
+	}
+
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			stats.DiskBytes += info.Size()
+		}
+		return nil
+	})
+	return stats, nil
+}
+
+// purgeQueue removes every record of the queue at path
+func purgeQueue(path string) error {
+	q, err := openDiskQueue(path)
+	if err != nil {
+		return err
+	}
+	// Drop closes the queue and removes its dir, the sender creates it again
+	q.Drop()
+	return nil
+}
+
+// recordTime returns the driver_timestamp of a log document
+func recordTime(doc []byte) time.Time {
+	var msg struct {
+		Time string `json:"driver_timestamp"`
+	}
+	if err := json.Unmarshal(doc, &msg); err != nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339Nano, msg.Time)
+	return t
+}
+
+func age(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
+func timestamp(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beeker1121/goque"
+)
+
+func TestQueueCommand(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	q, err := goque.OpenQueue(filepath.Join(dir, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest := time.Now().Add(-time.Hour).UTC()
+	for i := 0; i < 3; i++ {
+		doc := fmt.Sprintf(`{"message":"%s%d","driver_timestamp":"%s"}`, t.Name(), i,
+			oldest.Add(time.Duration(i)*time.Minute).Format(time.RFC3339Nano))
+		if _, err := q.Enqueue([]byte(doc)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Close()
+
+	var out bytes.Buffer
+	if err := queueCommand([]string{"ls", "--dir", dir}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "0 ") || !strings.Contains(lines[1], " 3 ") ||
+		!strings.HasSuffix(lines[1], "1h0m0s") {
+		t.Fatalf("Unexpected ls output:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := queueCommand([]string{"stat", "--dir", dir, "--hash", "0"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "records:        3") || !strings.Contains(out.String(), oldest.Format(time.RFC3339)) {
+		t.Fatalf("Unexpected stat output:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := queueCommand([]string{"dump", "--dir", dir, "--limit", "2"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 2 || !strings.Contains(lines[1], t.Name()+"1") {
+		t.Fatalf("Unexpected dump output:\n%s", out.String())
+	}
+	// the records after the limit are not read
+	stats, err := readQueue(filepath.Join(dir, "0"), nil, func(queueRecord) bool { return false })
+	if err != nil || stats.Records != 1 {
+		t.Fatalf("Unexpected records read %+v %v", stats, err)
+	}
+
+	if err := queueCommand([]string{"purge", "--dir", dir}, &out); err == nil {
+		t.Fatal("Expected purge to require --hash or --all")
+	}
+
+	accepting := NewtestHTTPMock(t, []int{http.StatusOK})
+	go accepting.Serve()
+	defer accepting.Close()
+	out.Reset()
+	if err := queueCommand([]string{"replay", "--dir", dir, "--url", accepting.URL(), "--token", accepting.Token(),
+		"--purge"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(accepting.messages) != 3 || accepting.messages[2]["message"] != t.Name()+"2" {
+		t.Fatalf("Unexpected replayed messages: %v", accepting.messages)
+	}
+	if !strings.Contains(out.String(), "replayed 3 of 3 records") || isDiskQueue(filepath.Join(dir, "0")) {
+		t.Fatalf("Queue was not purged after the replay:\n%s", out.String())
+	}
+}
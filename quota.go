@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/go-units"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+const (
+	//log-opt
+	logzioQueueMaxSize  = "logzio-queue-max-size"
+	logzioQueueEviction = "logzio-queue-eviction"
+
+	envQueueMaxSize      = "LOGZIO_QUEUE_MAX_SIZE"
+	envQueueEviction     = "LOGZIO_QUEUE_EVICTION"
+	envQueueTotalMaxSize = "LOGZIO_QUEUE_TOTAL_MAX_SIZE"
+)
+
+// globalDiskQuota is shared by the queues of all the senders, nil when LOGZIO_QUEUE_TOTAL_MAX_SIZE isn't set
+var globalDiskQuota *shipper.DiskQuota
+
+// getDiskQuota reads the cap of all the queues from the plugin env
+func getDiskQuota() (*shipper.DiskQuota, error) {
+	str := os.Getenv(envQueueTotalMaxSize)
+	if str == "" {
+		return nil, nil
+	}
+	size, err := units.RAMInBytes(str)
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("%s is not a valid size: %s\n", envQueueTotalMaxSize, str)
+	}
+	return shipper.NewDiskQuota(size), nil
+}
+
+// getQueueQuota returns the cap of a single queue directory and what to evict when it is reached
+func getQueueQuota(loggerInfo logger.Info) (int64, shipper.EvictionPolicy, error) {
+	var size int64
+	var err error
+	if str := getOptOrEnv(loggerInfo, logzioQueueMaxSize, envQueueMaxSize); str != "" {
+		if size, err = units.RAMInBytes(str); err != nil || size < 0 {
+			return 0, "", fmt.Errorf("%s is not a valid size: %s\n", logzioQueueMaxSize, str)
+		}
+	}
+	policy := shipper.EvictionPolicy(getOptOrEnv(loggerInfo, logzioQueueEviction, envQueueEviction))
+	switch policy {
+	case "":
+		policy = shipper.EvictOldestFirst
+	case shipper.EvictOldestFirst, shipper.EvictRejectNew:
+	default:
+		return 0, "", fmt.Errorf("%s must be %s or %s: %s\n", logzioQueueEviction,
+			shipper.EvictOldestFirst, shipper.EvictRejectNew, policy)
+	}
+	return size, policy, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+func TestQueueQuotaOptions(t *testing.T) {
+	size, policy, err := getQueueQuota(logger.Info{Config: map[string]string{
+		logzioQueueMaxSize:  "10m",
+		logzioQueueEviction: "reject-new",
+	}})
+	if err != nil || size != 10*1024*1024 || policy != shipper.EvictRejectNew {
+		t.Fatalf("Unexpected quota %d %s %v", size, policy, err)
+	}
+	if size, policy, _ = getQueueQuota(logger.Info{}); size != 0 || policy != shipper.EvictOldestFirst {
+		t.Fatalf("Unexpected default quota %d %s", size, policy)
+	}
+	for opt, value := range map[string]string{logzioQueueMaxSize: "ten", logzioQueueEviction: "newest-first"} {
+		if _, _, err := getQueueQuota(logger.Info{Config: map[string]string{opt: value}}); err == nil {
+			t.Fatalf("Expected an error for %s=%s", opt, value)
+		}
+	}
+
+	os.Setenv(envQueueTotalMaxSize, "1g")
+	defer os.Unsetenv(envQueueTotalMaxSize)
+	quota, err := getDiskQuota()
+	if err != nil || quota == nil {
+		t.Fatalf("Unexpected global quota %v", err)
+	}
+}
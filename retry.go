@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+const (
+	//log-opt
+	logzioRetryInitialBackoff = "logzio-retry-initial-backoff"
+	logzioRetryMaxBackoff     = "logzio-retry-max-backoff"
+	logzioRetryMultiplier     = "logzio-retry-multiplier"
+	logzioRetryJitter         = "logzio-retry-jitter"
+	logzioRetryMaxAttempts    = "logzio-retry-max-attempts"
+	logzioRetryMaxAge         = "logzio-retry-max-age"
+
+	envRetryInitialBackoff = "LOGZIO_RETRY_INITIAL_BACKOFF"
+	envRetryMaxBackoff     = "LOGZIO_RETRY_MAX_BACKOFF"
+	envRetryMultiplier     = "LOGZIO_RETRY_MULTIPLIER"
+	envRetryJitter         = "LOGZIO_RETRY_JITTER"
+	envRetryMaxAttempts    = "LOGZIO_RETRY_MAX_ATTEMPTS"
+	envRetryMaxAge         = "LOGZIO_RETRY_MAX_AGE"
+)
+
+// getRetryPolicy builds the retry policy of the sender from the log-opts, falling back to the plugin env
+func getRetryPolicy(loggerInfo logger.Info) (shipper.RetryPolicy, error) {
+	policy := shipper.DefaultRetryPolicy()
+	var err error
+
+	for _, d := range []struct {
+		opt   string
+		env   string
+		value *time.Duration
+	}{
+		{logzioRetryInitialBackoff, envRetryInitialBackoff, &policy.InitialBackoff},
+		{logzioRetryMaxBackoff, envRetryMaxBackoff, &policy.MaxBackoff},
+		{logzioRetryMaxAge, envRetryMaxAge, &policy.MaxAge},
+	} {
+		if str := getOptOrEnv(loggerInfo, d.opt, d.env); str != "" {
+			if *d.value, err = time.ParseDuration(str); err != nil {
+				return policy, fmt.Errorf("%s is not a valid duration: %s\n", d.opt, str)
+			}
+		}
+	}
+
+	for _, f := range []struct {
+		opt   string
+		env   string
+		value *float64
+	}{
+		{logzioRetryMultiplier, envRetryMultiplier, &policy.Multiplier},
+		{logzioRetryJitter, envRetryJitter, &policy.Jitter},
+	} {
+		if str := getOptOrEnv(loggerInfo, f.opt, f.env); str != "" {
+			if *f.value, err = strconv.ParseFloat(str, 64); err != nil {
+				return policy, fmt.Errorf("%s is not a valid number: %s\n", f.opt, str)
+			}
+		}
+	}
+
+	if str := getOptOrEnv(loggerInfo, logzioRetryMaxAttempts, envRetryMaxAttempts); str != "" {
+		if policy.MaxAttempts, err = strconv.Atoi(str); err != nil {
+			return policy, fmt.Errorf("%s is not a valid number: %s\n", logzioRetryMaxAttempts, str)
+		}
+	}
+
+	if err := policy.Validate(); err != nil {
+		return policy, fmt.Errorf("invalid retry policy: %s\n", err)
+	}
+	return policy, nil
+}
@@ -0,0 +1,187 @@
+package shipper
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures    = 8
+	defaultBreakerErrorRate   = 0.5
+	defaultBreakerWindow      = 20
+	defaultBreakerOpenTimeout = 30 * time.Second
+)
+
+// BreakerPolicy controls when the sender stops calling an unhealthy listener
+type BreakerPolicy struct {
+	// ConsecutiveFailures opens the breaker after this many failed attempts in a row, 0 disables it
+	ConsecutiveFailures int
+	// ErrorRate opens the breaker when this fraction (0 - 1) of the last Window attempts failed, 0 disables it
+	ErrorRate float64
+	// Window is the number of recent attempts ErrorRate is computed on
+	Window int
+	// OpenTimeout is how long the breaker stays open before a probe is sent
+	OpenTimeout time.Duration
+}
+
+// DefaultBreakerPolicy returns the policy used when none is set
+func DefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{
+		ConsecutiveFailures: defaultBreakerFailures,
+		ErrorRate:           defaultBreakerErrorRate,
+		Window:              defaultBreakerWindow,
+		OpenTimeout:         defaultBreakerOpenTimeout,
+	}
+}
+
+// Validate checks the policy values are in range
+func (p BreakerPolicy) Validate() error {
+	if p.ConsecutiveFailures < 0 || p.Window < 0 || p.OpenTimeout < 0 {
+		return fmt.Errorf("breaker failures, window and open timeout can't be negative")
+	}
+	if p.ErrorRate < 0 || p.ErrorRate > 1 {
+		return fmt.Errorf("breaker error rate must be between 0 and 1, got %g", p.ErrorRate)
+	}
+	if p.ErrorRate > 0 && p.Window == 0 {
+		return fmt.Errorf("breaker error rate requires a window")
+	}
+	return nil
+}
+
+// BreakerState is the state of the circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed sends as usual
+	BreakerClosed BreakerState = iota
+	// BreakerOpen keeps the data in the disk queue without calling the listener
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe through after the open timeout
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// BreakerStats is a snapshot of the circuit breaker
+type BreakerStats struct {
+	State               string    `json:"state"`
+	Since               time.Time `json:"since"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	ErrorRate           float64   `json:"error_rate"`
+	Transitions         int       `json:"transitions"`
+}
+
+type circuitBreaker struct {
+	mu          sync.Mutex
+	policy      BreakerPolicy
+	state       BreakerState
+	since       time.Time
+	failures    int
+	results     []bool // ring of the last Window attempts, true is a failure
+	next        int
+	transitions int
+	onChange    func(from BreakerState, to BreakerState, reason string)
+}
+
+func newCircuitBreaker(policy BreakerPolicy) *circuitBreaker {
+	return &circuitBreaker{
+		policy: policy,
+		since:  time.Now(),
+	}
+}
+
+func (b *circuitBreaker) enabled() bool {
+	return b.policy.ConsecutiveFailures > 0 || b.policy.ErrorRate > 0
+}
+
+// allow reports whether a request may be sent now
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen && time.Since(b.since) >= b.policy.OpenTimeout {
+		b.transition(BreakerHalfOpen, "probing the listener")
+	}
+	return b.state != BreakerOpen
+}
+
+// record updates the breaker with the result of a request
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.enabled() {
+		return
+	}
+	if b.policy.Window > 0 {
+		if len(b.results) < b.policy.Window {
+			b.results = append(b.results, failed)
+		} else {
+			b.results[b.next] = failed
+			b.next = (b.next + 1) % b.policy.Window
+		}
+	}
+	if !failed {
+		b.failures = 0
+		if b.state != BreakerClosed {
+			b.results = b.results[:0]
+			b.next = 0
+			b.transition(BreakerClosed, "listener is healthy")
+		}
+		return
+	}
+
+	b.failures++
+	switch {
+	case b.state == BreakerHalfOpen:
+		b.transition(BreakerOpen, "probe failed")
+	case b.state == BreakerOpen:
+	case b.policy.ConsecutiveFailures > 0 && b.failures >= b.policy.ConsecutiveFailures:
+		b.transition(BreakerOpen, fmt.Sprintf("%d consecutive failures", b.failures))
+	case b.policy.ErrorRate > 0 && len(b.results) == b.policy.Window && b.errorRate() >= b.policy.ErrorRate:
+		b.transition(BreakerOpen, fmt.Sprintf("error rate %g", b.errorRate()))
+	}
+}
+
+func (b *circuitBreaker) errorRate() float64 {
+	if len(b.results) == 0 {
+		return 0
+	}
+	failed := 0
+	for _, f := range b.results {
+		if f {
+			failed++
+		}
+	}
+	return float64(failed) / float64(len(b.results))
+}
+
+func (b *circuitBreaker) transition(to BreakerState, reason string) {
+	from := b.state
+	b.state = to
+	b.since = time.Now()
+	b.transitions++
+	if b.onChange != nil {
+		b.onChange(from, to, reason)
+	}
+}
+
+func (b *circuitBreaker) stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BreakerStats{
+		State:               b.state.String(),
+		Since:               b.since,
+		ConsecutiveFailures: b.failures,
+		ErrorRate:           b.errorRate(),
+		Transitions:         b.transitions,
+	}
+}
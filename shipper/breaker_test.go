@@ -0,0 +1,83 @@
+package shipper
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	b := newCircuitBreaker(BreakerPolicy{ConsecutiveFailures: 3, OpenTimeout: 50 * time.Millisecond})
+	var transitions []string
+	b.onChange = func(from BreakerState, to BreakerState, reason string) {
+		transitions = append(transitions, from.String()+">"+to.String())
+	}
+	b.record(true)
+	b.record(true)
+	b.record(false)
+	b.record(true)
+	b.record(true)
+	if !b.allow() {
+		t.Fatal("Breaker opened before 3 consecutive failures")
+	}
+	b.record(true)
+	if b.allow() {
+		t.Fatal("Breaker is not open after 3 consecutive failures")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.allow() || b.stats().State != "half-open" {
+		t.Fatalf("Breaker did not let a probe through, state %s", b.stats().State)
+	}
+	b.record(true)
+	if b.allow() {
+		t.Fatal("Breaker is not open after a failed probe")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	b.allow()
+	b.record(false)
+	if !b.allow() || b.stats().State != "closed" {
+		t.Fatalf("Breaker did not close after a successful probe, state %s", b.stats().State)
+	}
+
+	expected := []string{"closed>open", "open>half-open", "half-open>open", "open>half-open", "half-open>closed"}
+	if len(transitions) != len(expected) {
+		t.Fatalf("Unexpected transitions %v", transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Fatalf("Unexpected transitions %v", transitions)
+		}
+	}
+	if b.stats().Transitions != len(expected) {
+		t.Fatalf("Unexpected transitions count %d", b.stats().Transitions)
+	}
+}
+
+func TestBreakerErrorRate(t *testing.T) {
+	b := newCircuitBreaker(BreakerPolicy{ErrorRate: 0.5, Window: 4, OpenTimeout: time.Minute})
+	b.record(true)
+	b.record(false)
+	b.record(true)
+	if !b.allow() {
+		t.Fatal("Breaker opened before the window is full")
+	}
+	b.record(false)
+	if !b.allow() {
+		t.Fatal("Breaker opened on a successful attempt")
+	}
+	b.record(true)
+	if b.allow() {
+		t.Fatalf("Breaker is not open at error rate %g", b.stats().ErrorRate)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(BreakerPolicy{})
+	for i := 0; i < 100; i++ {
+		b.record(true)
+	}
+	if !b.allow() {
+		t.Fatal("Disabled breaker opened")
+	}
+}
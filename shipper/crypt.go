@@ -0,0 +1,129 @@
+package shipper
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// sealedMagic starts every encrypted record, plain records are json documents and start with '{'
+const sealedMagic = "LZE1"
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,255}$`)
+
+// Keyring holds the AES-GCM keys of the disk queue. New records are sealed with the current key,
+// the older keys are only used to open records written before a rotation.
+type Keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring reads keys as "<id>:<base64 key>" entries separated by new lines or commas.
+// The last entry is the current key. Keys are 16, 24 or 32 bytes long, for AES-128, AES-192 or AES-256.
+func ParseKeyring(text string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, entry := range strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || !keyIDPattern.MatchString(parts[0]) {
+			return nil, fmt.Errorf("encryption key entries must be <id>:<base64 key>, with an id of letters, digits, '.', '_' or '-'")
+		}
+		id := parts[0]
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("encryption key %s is set twice", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not valid base64", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s must be 16, 24 or 32 bytes, got %d", id, len(key))
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		k.current = id
+	}
+	if k.current == "" {
+		return nil, fmt.Errorf("no encryption key found")
+	}
+	return k, nil
+}
+
+// CurrentKeyID returns the id of the key new records are sealed with
+func (k *Keyring) CurrentKeyID() string {
+	return k.current
+}
+
+// SetKeyring encrypts the payloads in the disk queue and the dead-letter dir, nil keeps them in plain text
+func SetKeyring(k *Keyring) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.keyring = k
+		return nil
+	}
+}
+
+// seal encrypts a record as magic | id length | id | nonce | ciphertext, the header is authenticated too.
+// A nil keyring returns the record as is.
+func (k *Keyring) seal(plain []byte) ([]byte, error) {
+	if k == nil {
+		return plain, nil
+	}
+	aead := k.keys[k.current]
+	header := make([]byte, 0, len(sealedMagic)+1+len(k.current)+aead.NonceSize())
+	header = append(header, sealedMagic...)
+	header = append(header, byte(len(k.current)))
+	header = append(header, k.current...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, plain, header), nil
+}
+
+// Open decrypts a sealed record. Plain records, written before encryption was enabled, are returned as is,
+// so the keyring may be nil.
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	if !IsSealed(data) {
+		return data, nil
+	}
+	idEnd := len(sealedMagic) + 1 + int(data[len(sealedMagic)])
+	if len(data) < idEnd {
+		return nil, fmt.Errorf("encrypted record is truncated")
+	}
+	id := string(data[len(sealedMagic)+1 : idEnd])
+	if k == nil {
+		return nil, fmt.Errorf("record is encrypted with key %s, but no encryption key is set", id)
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("record is encrypted with unknown key %s", id)
+	}
+	if len(data) < idEnd+aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted record is truncated")
+	}
+	nonce := data[idEnd : idEnd+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[idEnd+aead.NonceSize():], data[:idEnd])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt a record with key %s: %s", id, err)
+	}
+	return plain, nil
+}
+
+// IsSealed reports whether a record is encrypted
+func IsSealed(data []byte) bool {
+	return len(data) > len(sealedMagic) && bytes.HasPrefix(data, []byte(sealedMagic))
+}
@@ -0,0 +1,168 @@
+package shipper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestParseKeyring(t *testing.T) {
+	k, err := ParseKeyring(fmt.Sprintf("# rotated on monday\nold:%s\n\nnew:%s\n", testKey(1), testKey(2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.CurrentKeyID() != "new" {
+		t.Fatalf("Unexpected current key %s", k.CurrentKeyID())
+	}
+	for _, keys := range []string{
+		"",
+		"new" + testKey(1),
+		"n w:" + testKey(1),
+		"new:not base64",
+		"new:" + base64.StdEncoding.EncodeToString([]byte("short")),
+		fmt.Sprintf("new:%s,new:%s", testKey(1), testKey(2)),
+	} {
+		if _, err := ParseKeyring(keys); err == nil {
+			t.Fatalf("Expected an error for %q", keys)
+		}
+	}
+}
+
+func TestSealAndOpen(t *testing.T) {
+	old, _ := ParseKeyring("old:" + testKey(1))
+	rotated, _ := ParseKeyring(fmt.Sprintf("old:%s,new:%s", testKey(1), testKey(2)))
+	other, _ := ParseKeyring("other:" + testKey(3))
+
+	plain := []byte(`{"message":"secret"}`)
+	sealed, err := old.seal(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || bytes.Contains(sealed, []byte("secret")) {
+		t.Fatalf("Record is not encrypted: %q", sealed)
+	}
+	// records of the previous key are readable after a rotation
+	if opened, err := rotated.Open(sealed); err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("Failed to open a record of a rotated key: %q %v", opened, err)
+	}
+	if _, err := other.Open(sealed); err == nil || !strings.Contains(err.Error(), "unknown key old") {
+		t.Fatalf("Expected an unknown key error: %v", err)
+	}
+	var none *Keyring
+	if _, err := none.Open(sealed); err == nil {
+		t.Fatal("Expected an error opening a sealed record without keys")
+	}
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := old.Open(tampered); err == nil {
+		t.Fatal("Expected an error opening a tampered record")
+	}
+	// plain records written before encryption was enabled
+	if opened, err := rotated.Open(plain); err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("Failed to open a plain record: %q %v", opened, err)
+	}
+	if sealed, _ := rotated.seal(plain); !bytes.HasPrefix(sealed, []byte(sealedMagic+"\x03new")) {
+		t.Fatalf("Record is not sealed with the current key: %q", sealed)
+	}
+}
+
+func TestEncryptedQueue(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, string(body))
+		mu.Unlock()
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	queueDir := filepath.Join(dir, "queue")
+	deadLetters := filepath.Join(dir, "dead-letter")
+	retry := SetRetryPolicy(RetryPolicy{Multiplier: 1, AttemptsPerDrain: 1})
+	oldKeys, _ := ParseKeyring("old:" + testKey(1))
+	newKeys, _ := ParseKeyring("new:" + testKey(2))
+	bothKeys, _ := ParseKeyring(fmt.Sprintf("old:%s,new:%s", testKey(1), testKey(2)))
+
+	// a plain record left by a previous version and one sealed with the old key
+	l := newQuotaTestSender(t, queueDir, down.URL, retry)
+	l.Send([]byte(`{"message":"plain"}`))
+	l.Stop()
+	l = newQuotaTestSender(t, queueDir, down.URL, retry, SetKeyring(oldKeys))
+	l.Send([]byte(`{"message":"old key"}`))
+	for _, record := range queueContent(t, l) {
+		if strings.Contains(record, "old key") {
+			t.Fatalf("Record is not encrypted on disk: %q", record)
+		}
+	}
+	l.Stop()
+
+	// the failed batch of both records was requeued sealed with the old key.
+	// Once the old key is gone, it is dead-lettered as is instead of being lost.
+	l = newQuotaTestSender(t, queueDir, up.URL, SetKeyring(newKeys), SetDeadLetterDirectory(deadLetters))
+	l.Send([]byte(`{"message":"new key"}`))
+	l.Drain()
+	mu.Lock()
+	if len(received) != 1 || received[0] != "{\"message\":\"new key\"}\n" {
+		t.Fatalf("Unexpected requests %q", received)
+	}
+	mu.Unlock()
+	records, err := ReadDeadLetters(deadLetters)
+	if err != nil || len(records) != 1 || !records[0].Encrypted || strings.Contains(records[0].Payload, "old key") {
+		t.Fatalf("Unexpected dead letters %+v %v", records, err)
+	}
+	if err := records[0].Decrypt(newKeys); err == nil {
+		t.Fatal("Expected an error decrypting the dead letter without the old key")
+	}
+	l.Stop()
+
+	// resubmitting with the old key back in the keyring
+	l = newQuotaTestSender(t, queueDir, up.URL, SetKeyring(bothKeys), SetDeadLetterDirectory(deadLetters))
+	defer l.Stop()
+	if sent, err := l.ResubmitDeadLetters(deadLetters); err != nil || sent != 1 {
+		t.Fatalf("Unexpected resubmit %d %v", sent, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[1] != "{\"message\":\"plain\"}\n{\"message\":\"old key\"}" {
+		t.Fatalf("Unexpected requests %q", received)
+	}
+}
+
+func TestRequeueLogsNoPayload(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	keys, _ := ParseKeyring("key-1:" + testKey(1))
+	var debug bytes.Buffer
+	l := newQuotaTestSender(t, dir, down.URL, SetKeyring(keys), SetDebug(&debug),
+		SetRetryPolicy(RetryPolicy{Multiplier: 1, AttemptsPerDrain: 1}))
+	l.Send([]byte(`{"message":"secret"}`))
+	l.Stop()
+	if strings.Contains(debug.String(), "secret") {
+		t.Fatalf("The decrypted payload is in the debug log:\n%s", debug.String())
+	}
+	if !strings.Contains(debug.String(), "Requeue 20 bytes sealed with key key-1") {
+		t.Fatalf("Expected the requeue size and key in the debug log:\n%s", debug.String())
+	}
+}
@@ -0,0 +1,227 @@
+package shipper
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const deadLetterExt = ".json"
+
+// DeadLetter is a batch the listener rejected or that ran out of retries
+type DeadLetter struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code"`
+	Response   string    `json:"response,omitempty"`
+	Reason     string    `json:"reason"`
+	Attempts   int       `json:"attempts"`
+	Payload    string    `json:"payload"`
+	// Encrypted is set when Payload is a base64 sealed record, see Decrypt
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Path of the file the record was read from
+	Path string `json:"-"`
+}
+
+// Lines returns the number of log lines in the batch
+func (d *DeadLetter) Lines() int {
+	lines := 0
+	for _, line := range strings.Split(d.Payload, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines++
+		}
+	}
+	return lines
+}
+
+// Decrypt replaces an encrypted payload with the plain text one, it does nothing for plain records
+func (d *DeadLetter) Decrypt(k *Keyring) error {
+	if !d.Encrypted {
+		return nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(d.Payload)
+	if err != nil {
+		return err
+	}
+	plain, err := k.Open(sealed)
+	if err != nil {
+		return err
+	}
+	d.Payload = string(plain)
+	d.Encrypted = false
+	return nil
+}
+
+// SetDeadLetterDirectory keeps batches that will not be retried anymore in this dir instead of dropping them
+func SetDeadLetterDirectory(dir string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.deadLetterDir = dir
+		return nil
+	}
+}
+
+// deadLetter stores a batch that will not be retried anymore, or drops it when there is no dead-letter dir
+func (l *LogzioSender) deadLetter(b *batch, statusCode int, response string, reason string) {
+	atomic.AddInt64(&l.counters.deadLettered, 1)
+	if l.deadLetterDir == "" || !l.isEnoughDiskSpace() {
+		l.errorLog("Logz.io: dropping %d bytes after %d attempts, %s (status %d)\n",
+			len(b.data), b.attempts, reason, statusCode)
+		return
+	}
+	record := &DeadLetter{
+		Time:       time.Now().UTC(),
+		StatusCode: statusCode,
+		Response:   response,
+		Reason:     reason,
+		Attempts:   b.attempts,
+		Payload:    string(b.data),
+	}
+	path, err := l.writeDeadLetter(record, b.data)
+	if err != nil {
+		l.errorLog("Logz.io: dropping %d bytes after %d attempts, %s (status %d), could not dead-letter: %s\n",
+			len(b.data), b.attempts, reason, statusCode, err)
+		return
+	}
+	l.errorLog("Logz.io: %s (status %d) after %d attempts, batch saved to %s\n", reason, statusCode, b.attempts, path)
+}
+
+// writeDeadLetter seals the payload when the sender has a keyring, data may already be sealed
+func (l *LogzioSender) writeDeadLetter(record *DeadLetter, data []byte) (string, error) {
+	if l.keyring != nil || IsSealed(data) {
+		sealed := data
+		if !IsSealed(data) {
+			var err error
+			if sealed, err = l.keyring.seal(data); err != nil {
+				return "", err
+			}
+		}
+		record.Payload = base64.StdEncoding.EncodeToString(sealed)
+		record.Encrypted = true
+	}
+	dir := l.deadLetterDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%d-%d%s", record.Time.UnixNano(), record.StatusCode, deadLetterExt)
+	tmp := filepath.Join(dir, "."+name)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	return path, os.Rename(tmp, path)
+}
+
+// deadLetterSealed keeps a queue record that can't be decrypted, so it can be resubmitted once the key is back
+func (l *LogzioSender) deadLetterSealed(data []byte, reason string) {
+	atomic.AddInt64(&l.counters.deadLettered, 1)
+	if l.deadLetterDir == "" {
+		l.errorLog("Logz.io: dropping a log of %s, %s\n", l.dir, reason)
+		return
+	}
+	record := &DeadLetter{
+		Time:   time.Now().UTC(),
+		Reason: reason,
+	}
+	path, err := l.writeDeadLetter(record, data)
+	if err != nil {
+		l.errorLog("Logz.io: dropping a log of %s, %s, could not dead-letter: %s\n", l.dir, reason, err)
+		return
+	}
+	l.errorLog("Logz.io: %s, log saved to %s\n", reason, path)
+}
+
+// ReadDeadLetters returns the dead-lettered batches in dir, oldest first
+func ReadDeadLetters(dir string) ([]*DeadLetter, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && !strings.HasPrefix(f.Name(), ".") && strings.HasSuffix(f.Name(), deadLetterExt) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	var records []*DeadLetter
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return records, err
+		}
+		record := &DeadLetter{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return records, fmt.Errorf("%s: %s", path, err)
+		}
+		record.Path = path
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// ResubmitDeadLetters sends the dead-lettered batches in dir with the url and token of this sender.
+// A batch is removed from dir once it is sent, or dead-lettered again by this sender.
+// It stops at the first batch that still fails with a retryable error.
+func (l *LogzioSender) ResubmitDeadLetters(dir string) (int, error) {
+	records, err := ReadDeadLetters(dir)
+	if err != nil {
+		return 0, err
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	sent := 0
+	for i, record := range records {
+		if err := record.Decrypt(l.keyring); err != nil {
+			return sent, fmt.Errorf("%s: %s", record.Path, err)
+		}
+		switch l.sendBatch(&batch{data: []byte(record.Payload)}) {
+		case sendRetryable:
+			return sent, fmt.Errorf("listener is not available, %d batches left in %s", len(records)-i, dir)
+		case sendSucceeded:
+			sent++
+		}
+		if err := os.Remove(record.Path); err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// Replay sends records taken from another queue with the url and token of this sender, batched like a drain.
+// Rejected batches are dead-lettered by this sender. It returns the number of records that were handled,
+// and stops at the first batch that still fails with a retryable error.
+func (l *LogzioSender) Replay(records [][]byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	done := 0
+	for done < len(records) {
+		var buf bytes.Buffer
+		end := done
+		for end < len(records) && (buf.Len() == 0 || buf.Len()+len(records[end])+1 < maxSize) {
+			buf.Write(records[end])
+			buf.WriteByte('\n')
+			end++
+		}
+		if l.sendBatch(&batch{data: buf.Bytes()}) == sendRetryable {
+			return done, fmt.Errorf("listener is not available, %d records left", len(records)-done)
+		}
+		done = end
+	}
+	return done, nil
+}
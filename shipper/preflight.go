@@ -0,0 +1,66 @@
+package shipper
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// preflightResult is the last preflight check of a sender
+type preflightResult struct {
+	mu    sync.Mutex
+	token string
+	at    time.Time
+	err   error
+}
+
+// Preflight sends an empty bulk to check that the listener is reachable and accepts the token.
+// The result is reused for ttl, unless the token was rotated in the meantime.
+func (l *LogzioSender) Preflight(ttl time.Duration) error {
+	l.preflight.mu.Lock()
+	defer l.preflight.mu.Unlock()
+	token := l.Token()
+	if l.preflight.token == token && time.Since(l.preflight.at) < ttl {
+		return l.preflight.err
+	}
+	l.preflight.token = token
+	l.preflight.at = time.Now()
+	l.preflight.err = l.preflightRequest(token)
+	return l.preflight.err
+}
+
+// preflightRequest does not go through makeHttpRequest, so it does not race with a drain
+func (l *LogzioSender) preflightRequest(token string) error {
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/?token=%s", l.host, token), bytes.NewReader(nil))
+	if err != nil {
+		return fmt.Errorf("%s", l.mask(err.Error()))
+	}
+	req.Header.Add("Content-Type", "text/plain")
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			// the url holds the token
+			err = urlErr.Err
+		}
+		return fmt.Errorf("listener %s is unreachable: %s", l.host, l.mask(err.Error()))
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if len(body) > maxResponseSize {
+		body = body[:maxResponseSize]
+	}
+	l.debugLog("sender.go: Preflight status code: %v \n", resp.StatusCode)
+	switch {
+	case resp.StatusCode < 300, resp.StatusCode == http.StatusBadRequest:
+		// the listener checks the token before the body, an empty bulk can be a bad request
+		return nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("listener %s rejected the token: %s", l.host, resp.Status)
+	default:
+		return fmt.Errorf("listener %s returned %s: %s", l.host, resp.Status, l.mask(string(body)))
+	}
+}
@@ -0,0 +1,182 @@
+package shipper
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/beeker1121/goque"
+)
+
+// EvictionPolicy decides what to do with a payload that doesn't fit in the disk quota
+type EvictionPolicy string
+
+const (
+	// EvictOldestFirst removes the oldest payloads of the queue until the new one fits
+	EvictOldestFirst EvictionPolicy = "oldest-first"
+	// EvictRejectNew drops the new payload and keeps the queue as is
+	EvictRejectNew EvictionPolicy = "reject-new"
+
+	quotaWarningEvery = time.Second * 10
+)
+
+// DiskQuota caps the bytes queued on disk by all the senders sharing it
+type DiskQuota struct {
+	mu       sync.Mutex
+	maxBytes int64
+	used     int64
+}
+
+// NewDiskQuota returns a quota of maxBytes shared by the senders it is set on
+func NewDiskQuota(maxBytes int64) *DiskQuota {
+	return &DiskQuota{maxBytes: maxBytes}
+}
+
+// Used returns the bytes currently queued by all the senders
+func (q *DiskQuota) Used() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.used
+}
+
+func (q *DiskQuota) fits(size int64) bool {
+	return q.maxBytes <= 0 || q.used+size <= q.maxBytes
+}
+
+// SetQueueQuota caps the bytes of this sender's queue, 0 means no cap
+func SetQueueQuota(maxBytes int64, policy EvictionPolicy) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if maxBytes < 0 {
+			return fmt.Errorf("queue quota can't be negative")
+		}
+		switch policy {
+		case "":
+			policy = EvictOldestFirst
+		case EvictOldestFirst, EvictRejectNew:
+		default:
+			return fmt.Errorf("unknown eviction policy %s", policy)
+		}
+		l.maxQueueBytes = maxBytes
+		l.evictionPolicy = policy
+		return nil
+	}
+}
+
+// SetDiskQuota shares a global quota with the other senders, nil means no global cap
+func SetDiskQuota(quota *DiskQuota) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.diskQuota = quota
+		return nil
+	}
+}
+
+// countQueueBytes sums the payloads already on disk when the queue is opened
+func (l *LogzioSender) countQueueBytes() error {
+	var size int64
+	for i := uint64(0); i < l.queue.Length(); i++ {
+		item, err := l.queue.PeekByOffset(i)
+		if err != nil {
+			return err
+		}
+		size += int64(len(item.Value))
+	}
+	l.quotaMu.Lock()
+	defer l.quotaMu.Unlock()
+	l.addQueueBytes(size)
+	return nil
+}
+
+// addQueueBytes updates the queue and the global usage, the caller holds quotaMu
+func (l *LogzioSender) addQueueBytes(size int64) {
+	atomic.AddInt64(&l.counters.queueBytes, size)
+	if l.diskQuota != nil {
+		l.diskQuota.mu.Lock()
+		l.diskQuota.used += size
+		l.diskQuota.mu.Unlock()
+	}
+}
+
+// released is called for every payload that leaves the queue
+func (l *LogzioSender) released(size int) {
+	l.quotaMu.Lock()
+	defer l.quotaMu.Unlock()
+	l.addQueueBytes(-int64(size))
+}
+
+// reserve makes room for a payload of size bytes in the queue and the global quota.
+// It returns false when the payload must be dropped.
+func (l *LogzioSender) reserve(size int) bool {
+	l.quotaMu.Lock()
+	defer l.quotaMu.Unlock()
+	if l.diskQuota != nil {
+		l.diskQuota.mu.Lock()
+		defer l.diskQuota.mu.Unlock()
+	}
+	need := int64(size)
+	for {
+		fitsQueue := l.maxQueueBytes <= 0 || atomic.LoadInt64(&l.counters.queueBytes)+need <= l.maxQueueBytes
+		if fitsQueue && (l.diskQuota == nil || l.diskQuota.fits(need)) {
+			atomic.AddInt64(&l.counters.queueBytes, need)
+			if l.diskQuota != nil {
+				l.diskQuota.used += need
+			}
+			return true
+		}
+		exceeded := quotaName(fitsQueue)
+		if l.evictionPolicy == EvictRejectNew {
+			l.quotaDrop("rejected a new log over the " + exceeded)
+			return false
+		}
+		// the global quota may be used by other queues, only this queue's payloads are evicted
+		item, err := l.queue.Dequeue()
+		if err != nil {
+			if err != goque.ErrEmpty {
+				l.debugLog("queue state: %s\n", err)
+			}
+			if fitsQueue {
+				l.quotaDrop("rejected a new log, the total quota is used by the other queues")
+			} else {
+				l.quotaDrop("rejected a log larger than the queue quota")
+			}
+			return false
+		}
+		atomic.AddInt64(&l.counters.queueBytes, -int64(len(item.Value)))
+		if l.diskQuota != nil {
+			l.diskQuota.used -= int64(len(item.Value))
+		}
+		atomic.AddInt64(&l.counters.evictedLogs, 1)
+		atomic.AddInt64(&l.counters.lostLogs, 1)
+		l.quotaWarning("evicted the oldest log")
+	}
+}
+
+// quotaName names the quota a payload doesn't fit in, the queue quota when it fails both
+func quotaName(fitsQueue bool) string {
+	if fitsQueue {
+		return "total quota"
+	}
+	return "queue quota"
+}
+
+func (l *LogzioSender) quotaDrop(what string) {
+	atomic.AddInt64(&l.counters.lostLogs, 1)
+	atomic.AddInt64(&l.counters.droppedLogs, 1)
+	l.quotaWarning(what)
+}
+
+// quotaWarning logs the quota counters at most once every quotaWarningEvery
+func (l *LogzioSender) quotaWarning(what string) {
+	now := time.Now()
+	if now.Sub(l.lastQuotaWarning) < quotaWarningEvery {
+		return
+	}
+	l.lastQuotaWarning = now
+	var global string
+	if l.diskQuota != nil && l.diskQuota.maxBytes > 0 {
+		global = fmt.Sprintf(", all queues use %d of %d bytes", l.diskQuota.used, l.diskQuota.maxBytes)
+	}
+	l.errorLog("Logz.io: disk quota of %s %s, queue uses %d of %d bytes%s, %d logs evicted and %d dropped so far\n",
+		l.dir, what, atomic.LoadInt64(&l.counters.queueBytes), l.maxQueueBytes, global,
+		atomic.LoadInt64(&l.counters.evictedLogs), atomic.LoadInt64(&l.counters.droppedLogs))
+}
@@ -0,0 +1,212 @@
+package shipper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newQuotaTestSender(t *testing.T, dir string, url string, options ...SenderOptionFunc) *LogzioSender {
+	options = append([]SenderOptionFunc{
+		SetTempDirectory(dir),
+		SetUrl(url),
+		SetCheckDiskSpace(false),
+		SetDrainDuration(time.Hour),
+	}, options...)
+	l, err := New("123456789", options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func queueContent(t *testing.T, l *LogzioSender) []string {
+	var content []string
+	for i := uint64(0); i < l.queue.Length(); i++ {
+		item, err := l.queue.PeekByOffset(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content = append(content, string(item.Value))
+	}
+	return content
+}
+
+func TestQueueQuotaEviction(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+
+	for policy, expected := range map[EvictionPolicy][]string{
+		EvictOldestFirst: {"log-3", "log-4"},
+		EvictRejectNew:   {"log-1", "log-2"},
+	} {
+		l := newQuotaTestSender(t, filepath.Join(dir, string(policy)), ts.URL, SetQueueQuota(10, policy))
+		for i := 1; i <= 4; i++ {
+			if err := l.Send([]byte(fmt.Sprintf("log-%d", i))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		content := queueContent(t, l)
+		if fmt.Sprint(content) != fmt.Sprint(expected) {
+			t.Fatalf("%s: unexpected queue %v", policy, content)
+		}
+		stats := l.Stats()
+		if stats.QueueBytes != 10 {
+			t.Fatalf("%s: unexpected queue bytes %d", policy, stats.QueueBytes)
+		}
+		if policy == EvictOldestFirst && (stats.EvictedLogs != 2 || stats.DroppedLogs != 0) {
+			t.Fatalf("%s: unexpected counters %+v", policy, stats)
+		}
+		if policy == EvictRejectNew && (stats.EvictedLogs != 0 || stats.DroppedLogs != 2) {
+			t.Fatalf("%s: unexpected counters %+v", policy, stats)
+		}
+		if err := l.Send([]byte("larger than the quota")); err != nil {
+			t.Fatal(err)
+		}
+		if policy == EvictOldestFirst && l.queue.Length() != 0 {
+			t.Fatalf("%s: expected the queue to be evicted for an oversized log", policy)
+		}
+		l.Stop()
+	}
+}
+
+func TestGlobalDiskQuota(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+
+	quota := NewDiskQuota(15)
+	first := newQuotaTestSender(t, filepath.Join(dir, "first"), ts.URL, SetDiskQuota(quota))
+	second := newQuotaTestSender(t, filepath.Join(dir, "second"), ts.URL, SetDiskQuota(quota),
+		SetQueueQuota(0, EvictRejectNew))
+	for i := 1; i <= 2; i++ {
+		first.Send([]byte(fmt.Sprintf("log-%d", i)))
+	}
+	second.Send([]byte("log-3"))
+	second.Send([]byte("log-4"))
+	if quota.Used() != 15 || second.Stats().DroppedLogs != 1 {
+		t.Fatalf("Unexpected global usage %d, second sender %+v", quota.Used(), second.Stats())
+	}
+	// the first queue only evicts its own logs
+	first.Send([]byte("log-5"))
+	if fmt.Sprint(queueContent(t, first)) != "[log-2 log-5]" || fmt.Sprint(queueContent(t, second)) != "[log-3]" {
+		t.Fatalf("Unexpected queues %v %v", queueContent(t, first), queueContent(t, second))
+	}
+
+	// sent logs release the quota
+	first.Drain()
+	if quota.Used() != 5 || first.Stats().QueueBytes != 0 {
+		t.Fatalf("Unexpected global usage after drain %d", quota.Used())
+	}
+	second.Stop()
+	if quota.Used() != 0 {
+		t.Fatalf("Unexpected global usage after stop %d", quota.Used())
+	}
+
+	// a reopened queue counts the logs left on disk
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	retry := SetRetryPolicy(RetryPolicy{Multiplier: 1, AttemptsPerDrain: 1})
+	third := newQuotaTestSender(t, filepath.Join(dir, "third"), down.URL, SetDiskQuota(quota), retry)
+	third.Send([]byte("log-6"))
+	third.Stop()
+	if quota.Used() != 0 {
+		t.Fatalf("Unexpected global usage after stop %d", quota.Used())
+	}
+	third = newQuotaTestSender(t, filepath.Join(dir, "third"), down.URL, SetDiskQuota(quota), retry)
+	if quota.Used() != 5 || third.Stats().QueueBytes != 5 {
+		t.Fatalf("Unexpected global usage after reopen %d", quota.Used())
+	}
+	third.Stop()
+	first.Stop()
+}
+
+func TestQuotaWarningNamesTheQuota(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	defer func(orig *os.File) { os.Stderr = orig }(os.Stderr)
+	os.Stderr = stderr
+
+	quota := NewDiskQuota(5)
+	first := newQuotaTestSender(t, filepath.Join(dir, "first"), ts.URL, SetDiskQuota(quota))
+	defer first.Stop()
+	first.Send([]byte("log-1"))
+	// the second queue is empty, only the total quota is full
+	second := newQuotaTestSender(t, filepath.Join(dir, "second"), ts.URL, SetDiskQuota(quota))
+	defer second.Stop()
+	second.Send([]byte("log-2"))
+	third := newQuotaTestSender(t, filepath.Join(dir, "third"), ts.URL, SetQueueQuota(3, EvictOldestFirst))
+	defer third.Stop()
+	third.Send([]byte("log-3"))
+
+	output, err := ioutil.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"rejected a new log, the total quota is used by the other queues",
+		"rejected a log larger than the queue quota",
+	} {
+		if !strings.Contains(string(output), expected) {
+			t.Fatalf("Expected %q in the warnings:\n%s", expected, output)
+		}
+	}
+}
+
+func TestDroppedLogsReported(t *testing.T) {
+	headers := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("logzio-shipper")
+	}))
+	defer ts.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+
+	l := newQuotaTestSender(t, dir, ts.URL, SetQueueQuota(10, EvictRejectNew))
+	defer l.Stop()
+	// the sends of the containers and routes are concurrent
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := l.Send([]byte(fmt.Sprintf("log-%d", i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	l.Drain()
+	if header := <-headers; header != "logzio-go/v1.0.0/0/1/NN:6" {
+		t.Fatalf("Expected the dropped logs in the header, got %s", header)
+	}
+	if err := l.Send([]byte("log-9")); err != nil {
+		t.Fatal(err)
+	}
+	l.Drain()
+	if header := <-headers; header != "logzio-go/v1.0.0/0/0" {
+		t.Fatalf("Expected the reported logs to be reset, got %s", header)
+	}
+}
@@ -0,0 +1,108 @@
+package shipper
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultInitialBackoff   = sendSleepingBackoff
+	defaultMaxBackoff       = time.Minute
+	defaultMultiplier       = 2.0
+	defaultAttemptsPerDrain = sendRetries
+)
+
+// RetryPolicy controls how a batch is retried when the listener fails
+type RetryPolicy struct {
+	// InitialBackoff is the delay after the first failed attempt
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts
+	MaxBackoff time.Duration
+	// Multiplier grows the delay after every failed attempt
+	Multiplier float64
+	// Jitter randomizes every delay by up to +/- this fraction of it (0 - 1)
+	Jitter float64
+	// AttemptsPerDrain is the number of attempts in a single drain before waiting for the next one
+	AttemptsPerDrain int
+	// MaxAttempts dead-letters a batch after this many attempts, 0 retries forever
+	MaxAttempts int
+	// MaxAge dead-letters a batch that keeps failing for longer than this, 0 retries forever
+	MaxAge time.Duration
+}
+
+// DefaultRetryPolicy returns the policy used when none is set
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		InitialBackoff:   defaultInitialBackoff,
+		MaxBackoff:       defaultMaxBackoff,
+		Multiplier:       defaultMultiplier,
+		AttemptsPerDrain: defaultAttemptsPerDrain,
+	}
+}
+
+// Validate checks the policy values are in range
+func (p RetryPolicy) Validate() error {
+	if p.InitialBackoff < 0 || p.MaxBackoff < 0 || p.MaxAge < 0 || p.MaxAttempts < 0 || p.AttemptsPerDrain < 0 {
+		return fmt.Errorf("retry backoff, age and attempts can't be negative")
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("retry multiplier must be at least 1, got %g", p.Multiplier)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1, got %g", p.Jitter)
+	}
+	return nil
+}
+
+// Backoff returns the delay after the given number of failed attempts, before jitter
+func (p RetryPolicy) Backoff(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(failures-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	return time.Duration(backoff)
+}
+
+func (p RetryPolicy) jittered(backoff time.Duration) time.Duration {
+	if p.Jitter <= 0 {
+		return backoff
+	}
+	return time.Duration(float64(backoff) * (1 + p.Jitter*(2*rand.Float64()-1)))
+}
+
+// exhausted reports whether a batch should not be retried anymore
+func (p RetryPolicy) exhausted(attempts int, firstFailure time.Time) bool {
+	if p.MaxAttempts > 0 && attempts >= p.MaxAttempts {
+		return true
+	}
+	return p.MaxAge > 0 && !firstFailure.IsZero() && time.Since(firstFailure) >= p.MaxAge
+}
+
+type sendResult int
+
+const (
+	sendSucceeded sendResult = iota
+	sendRetryable
+	sendRejected
+)
+
+// classify tells apart transient failures (network errors, 408, 429 and 5xx), which are retried,
+// from requests the listener will never accept (other 4xx, e.g. 401 bad token), which are not
+func classify(statusCode int) sendResult {
+	switch {
+	case statusCode >= 200 && statusCode < 300:
+		return sendSucceeded
+	case statusCode == http.StatusRequestTimeout, statusCode == http.StatusTooManyRequests:
+		return sendRetryable
+	case statusCode >= 400 && statusCode < 500:
+		return sendRejected
+	default:
+		return sendRetryable
+	}
+}
@@ -0,0 +1,62 @@
+package shipper
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}
+	expected := []time.Duration{0, time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for failures, backoff := range expected {
+		if got := policy.Backoff(failures); got != backoff {
+			t.Fatalf("Backoff(%d) = %v, expected %v", failures, got, backoff)
+		}
+	}
+}
+
+func TestJitter(t *testing.T) {
+	policy := RetryPolicy{Jitter: 0.25}
+	for i := 0; i < 1000; i++ {
+		got := policy.jittered(time.Second)
+		if got < 750*time.Millisecond || got > 1250*time.Millisecond {
+			t.Fatalf("Jittered backoff out of range: %v", got)
+		}
+	}
+}
+
+func TestExhausted(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 3, MaxAge: time.Minute}
+	if policy.exhausted(2, time.Now()) {
+		t.Fatal("Batch exhausted before max attempts")
+	}
+	if !policy.exhausted(3, time.Now()) {
+		t.Fatal("Batch not exhausted after max attempts")
+	}
+	if !policy.exhausted(1, time.Now().Add(-2*time.Minute)) {
+		t.Fatal("Batch not exhausted after max age")
+	}
+	if (RetryPolicy{}).exhausted(1000, time.Now().Add(-time.Hour)) {
+		t.Fatal("Batch exhausted without limits")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	expected := map[int]sendResult{
+		http.StatusOK:                    sendSucceeded,
+		http.StatusBadRequest:            sendRejected,
+		http.StatusUnauthorized:          sendRejected,
+		http.StatusRequestEntityTooLarge: sendRejected,
+		http.StatusRequestTimeout:        sendRetryable,
+		http.StatusTooManyRequests:       sendRetryable,
+		http.StatusInternalServerError:   sendRetryable,
+		http.StatusServiceUnavailable:    sendRetryable,
+		httpError:                        sendRetryable,
+	}
+	for statusCode, result := range expected {
+		if got := classify(statusCode); got != result {
+			t.Fatalf("classify(%d) = %d, expected %d", statusCode, got, result)
+		}
+	}
+}
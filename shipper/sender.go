@@ -0,0 +1,574 @@
+// Copyright © 2017 Douglas Chimento <dchimento@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package shipper is the https sender used by the driver. It started as a copy of
+// github.com/logzio/logzio-go and keeps the same API, but exposes the parts of the
+// HTTP client and the disk queue that the plugin needs to configure per sender.
+package shipper
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/beeker1121/goque"
+)
+
+const (
+	maxSize              = 3 * 1024 * 1024 // 3 mb
+	sendSleepingBackoff  = time.Second * 2
+	sendRetries          = 4
+	defaultHost          = "https://listener.logz.io:8071"
+	defaultDrainDuration = 5 * time.Second
+	defaultDiskThreshold = 95.0 // represent % of the disk
+	maxResponseSize      = 4 * 1024
+
+	httpError = -1
+
+	maskedToken = "xxxxx"
+)
+
+// LogzioSender buffers payloads in a disk queue and drains them to the listener
+type LogzioSender struct {
+	// first so the 64 bit counters are aligned on 32 bit platforms
+	counters      counters
+	queue         *goque.Queue
+	drainDuration time.Duration
+	buf           *bytes.Buffer
+	draining      int32
+	mux           sync.Mutex
+	// tokenMu guards the token, which can be rotated while a drain is running
+	tokenMu        sync.RWMutex
+	token          string
+	host           string
+	debug          io.Writer
+	diskThreshold  float32
+	checkDiskSpace int32 // 1 while the disk usage is checked, Send turns it off atomically
+	dir            string
+	httpClient     *http.Client
+	httpTransport  *http.Transport
+	isOpen         bool
+	retryPolicy    RetryPolicy
+	sleep          func(time.Duration)
+	pending        *batch
+	deadLetterDir  string
+	breaker        *circuitBreaker
+	// stop is closed by Close, it cuts short the wait between the attempts of a drain
+	stop     chan struct{}
+	stopOnce sync.Once
+	// quotaMu serializes the quota checks of Send with the evictions they trigger
+	quotaMu          sync.Mutex
+	maxQueueBytes    int64
+	evictionPolicy   EvictionPolicy
+	diskQuota        *DiskQuota
+	lastQuotaWarning time.Time
+	keyring          *Keyring
+	preflight        preflightResult
+}
+
+// batch is a request body that failed and waits for the next drain
+type batch struct {
+	data         []byte
+	attempts     int
+	firstFailure time.Time
+}
+
+// SenderOptionFunc options for logz
+type SenderOptionFunc func(*LogzioSender) error
+
+// New creates a new Logzio sender with a token and options
+func New(token string, options ...SenderOptionFunc) (*LogzioSender, error) {
+	l := &LogzioSender{
+		buf:            bytes.NewBuffer(make([]byte, maxSize)),
+		drainDuration:  defaultDrainDuration,
+		host:           defaultHost,
+		token:          token,
+		dir:            fmt.Sprintf("%s%s%s%s%d", os.TempDir(), string(os.PathSeparator), "logzio-buffer", string(os.PathSeparator), time.Now().UnixNano()),
+		diskThreshold:  defaultDiskThreshold,
+		checkDiskSpace: 1,
+		retryPolicy:    DefaultRetryPolicy(),
+		stop:           make(chan struct{}),
+		breaker:        newCircuitBreaker(DefaultBreakerPolicy()),
+		evictionPolicy: EvictOldestFirst,
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{},
+	}
+	// in case server side is sleeping - wait 10s instead of waiting for him to wake up
+	l.httpClient = &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * 10,
+	}
+	l.httpTransport = transport
+
+	for _, option := range options {
+		if err := option(l); err != nil {
+			return nil, err
+		}
+	}
+
+	l.breaker.onChange = func(from BreakerState, to BreakerState, reason string) {
+		l.infoLog("Logz.io: circuit breaker of %s %s -> %s, %s\n", l.dir, from, to, reason)
+	}
+
+	q, err := goque.OpenQueue(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	l.queue = q
+	if err := l.countQueueBytes(); err != nil {
+		q.Close()
+		return nil, err
+	}
+	l.isOpen = true
+	go l.drainTimer()
+	return l, nil
+}
+
+// SetTempDirectory Use this temporary dir
+func SetTempDirectory(dir string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.dir = dir
+		return nil
+	}
+}
+
+// SetUrl set the url which maybe different from the defaultUrl
+func SetUrl(url string) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.host = url
+		return nil
+	}
+}
+
+// SetDebug mode and send logs to this writer
+func SetDebug(debug io.Writer) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.debug = debug
+		return nil
+	}
+}
+
+// SetDrainDuration to change the interval between drains
+func SetDrainDuration(duration time.Duration) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.drainDuration = duration
+		return nil
+	}
+}
+
+// SetCheckDiskSpace to check if it crosses the maximum allowed disk usage
+func SetCheckDiskSpace(check bool) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.checkDiskSpace = 0
+		if check {
+			l.checkDiskSpace = 1
+		}
+		return nil
+	}
+}
+
+// SetDrainDiskThreshold to change the maximum used disk space
+func SetDrainDiskThreshold(th int) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		l.diskThreshold = float32(th)
+		return nil
+	}
+}
+
+// SetTLSConfig replaces the TLS configuration of the sender's transport
+func SetTLSConfig(config *tls.Config) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if config != nil {
+			l.httpTransport.TLSClientConfig = config
+		}
+		return nil
+	}
+}
+
+// SetProxy replaces the proxy function of the sender's transport
+func SetProxy(proxy func(*http.Request) (*url.URL, error)) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if proxy != nil {
+			l.httpTransport.Proxy = proxy
+		}
+		return nil
+	}
+}
+
+// SetRetryPolicy to change how failed batches are retried
+func SetRetryPolicy(policy RetryPolicy) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		if policy.AttemptsPerDrain < 1 {
+			policy.AttemptsPerDrain = defaultAttemptsPerDrain
+		}
+		l.retryPolicy = policy
+		return nil
+	}
+}
+
+// SetSleep to change how the sender waits between attempts, Close doesn't cut it short
+func SetSleep(sleep func(time.Duration)) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if sleep != nil {
+			l.sleep = sleep
+		}
+		return nil
+	}
+}
+
+// SetBreakerPolicy to change when the sender stops calling an unhealthy listener
+func SetBreakerPolicy(policy BreakerPolicy) SenderOptionFunc {
+	return func(l *LogzioSender) error {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+		l.breaker.policy = policy
+		return nil
+	}
+}
+
+func (l *LogzioSender) getIsOpen() bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.isOpen
+}
+
+func (l *LogzioSender) isEnoughDiskSpace() bool {
+	if atomic.LoadInt32(&l.checkDiskSpace) == 0 {
+		return true
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(l.dir, &stat); err != nil {
+		// keep the logs rather than dropping them because the usage is unknown
+		l.debugLog("sender.go: failed to get disk usage, not checking it anymore: %v\n", err)
+		atomic.StoreInt32(&l.checkDiskSpace, 0)
+		return true
+	}
+	total := stat.Blocks * uint64(stat.Bsize)
+	if total == 0 {
+		return true
+	}
+	free := stat.Bfree * uint64(stat.Bsize)
+	usage := float32(total-free) / float32(total) * 100
+	if usage > l.diskThreshold {
+		l.debugLog("Logz.io: Dropping logs, as FS used space on %s is %g percent,"+
+			" and the drop threshold is %g percent\n",
+			l.dir, usage, l.diskThreshold)
+		atomic.AddInt64(&l.counters.lostLogs, 1)
+		atomic.AddInt64(&l.counters.droppedLogs, 1)
+		return false
+	}
+	return true
+}
+
+// Send the payload to logz.io
+func (l *LogzioSender) Send(payload []byte) error {
+	payload, err := l.keyring.seal(payload)
+	if err != nil {
+		return err
+	}
+	if l.isEnoughDiskSpace() && l.reserve(len(payload)) {
+		if _, err := l.queue.Enqueue(payload); err != nil {
+			l.released(len(payload))
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop will do a final drain and close the LevelDB queue.
+// A batch that still fails is put back in the queue for the next run.
+func (l *LogzioSender) Stop() {
+	l.Drain()
+	l.Close()
+}
+
+// Close closes the LevelDB queue without a final drain, the queued logs are sent by the next sender of the directory
+func (l *LogzioSender) Close() {
+	l.stopWaiting()
+	// wait for a drain that is still running, it stops at its next wait
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.pending != nil {
+		l.requeue(l.pending.data)
+		l.pending = nil
+	}
+	l.isOpen = false
+	l.queue.Close()
+	// the data stays on disk, it is counted again when the queue is reopened
+	l.released(int(atomic.LoadInt64(&l.counters.queueBytes)))
+}
+
+// makeHttpRequest returns the status code, or httpError, and the start of the response body
+func (l *LogzioSender) makeHttpRequest(data []byte, attempt int) (int, string) {
+	var lost string
+	dropped := atomic.LoadInt64(&l.counters.lostLogs)
+	if dropped > 0 {
+		lost = fmt.Sprintf("1/NN:%d", dropped)
+	} else {
+		lost = "0"
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/?token=%s", l.host, l.Token()), bytes.NewReader(data))
+	if err != nil {
+		l.debugLog("sender.go: Error creating request %s\n", err)
+		return httpError, l.mask(err.Error())
+	}
+	req.Header.Add("Content-Type", "text/plain")
+	req.Header.Add("logzio-shipper", fmt.Sprintf("logzio-go/v1.0.0/%d/%s", attempt, lost))
+	l.debugLog("sender.go: Sending bulk of %v bytes\n", len(data))
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		l.debugLog("sender.go: Error sending logs %s\n", err)
+		if urlErr, ok := err.(*url.Error); ok {
+			// the url holds the token
+			return httpError, l.mask(urlErr.Err.Error())
+		}
+		return httpError, l.mask(err.Error())
+	}
+
+	defer resp.Body.Close()
+	statusCode := resp.StatusCode
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		l.debugLog("Error reading response body: %v", err)
+	}
+	if len(body) > maxResponseSize {
+		body = body[:maxResponseSize]
+	}
+	l.debugLog("sender.go: Response status code: %v \n", statusCode)
+	if statusCode == http.StatusOK {
+		// the logs dropped while the request was sent are reported by the next one
+		atomic.AddInt64(&l.counters.lostLogs, -dropped)
+	}
+	return statusCode, string(body)
+}
+
+// stopWaiting cuts short the wait of a running drain, so Close doesn't wait for its backoff
+func (l *LogzioSender) stopWaiting() {
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+}
+
+// wait sleeps between the attempts of a drain, it returns false when the sender is stopped before the end
+func (l *LogzioSender) wait(d time.Duration) bool {
+	if l.sleep != nil {
+		l.sleep(d)
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-l.stop:
+		return false
+	}
+}
+
+func (l *LogzioSender) drainTimer() {
+	for l.getIsOpen() {
+		time.Sleep(l.drainDuration)
+		l.Drain()
+	}
+}
+
+// Drain - Send remaining logs
+func (l *LogzioSender) Drain() {
+	if !atomic.CompareAndSwapInt32(&l.draining, 0, 1) {
+		l.debugLog("sender.go: Already draining\n")
+		return
+	}
+	defer atomic.StoreInt32(&l.draining, 0)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if !l.isOpen {
+		return
+	}
+	l.debugLog("sender.go: draining queue\n")
+	for {
+		b := l.pending
+		l.pending = nil
+		if b == nil {
+			if b = l.nextBatch(); b == nil {
+				return
+			}
+		}
+		if l.sendBatch(b) == sendRetryable {
+			l.pending = b
+			return
+		}
+	}
+}
+
+// sendBatch tries to send the batch according to the retry policy.
+// It returns sendRetryable when the batch should be retried on the next drain,
+// and sendRejected when it was dead-lettered.
+func (l *LogzioSender) sendBatch(b *batch) sendResult {
+	policy := l.retryPolicy
+	for attempt := 0; attempt < policy.AttemptsPerDrain; attempt++ {
+		if !l.breaker.allow() {
+			l.debugLog("sender.go: circuit breaker is open, keeping the logs in the queue\n")
+			return sendRetryable
+		}
+		if attempt > 0 {
+			backOff := policy.jittered(policy.Backoff(b.attempts))
+			l.debugLog("sender.go: failed to send logs, trying again in %v\n", backOff)
+			if !l.wait(backOff) {
+				l.debugLog("sender.go: the sender is stopped, keeping the logs in the queue\n")
+				return sendRetryable
+			}
+		}
+		statusCode, response := l.makeHttpRequest(b.data, b.attempts)
+		b.attempts++
+		result := classify(statusCode)
+		// a rejected batch is not the listener's fault
+		l.breaker.record(result == sendRetryable)
+		switch result {
+		case sendSucceeded:
+			atomic.AddInt64(&l.counters.sentBatches, 1)
+			return sendSucceeded
+		case sendRejected:
+			l.deadLetter(b, statusCode, response, "rejected by the listener")
+			return sendRejected
+		}
+		atomic.AddInt64(&l.counters.failedAttempts, 1)
+		if b.firstFailure.IsZero() {
+			b.firstFailure = time.Now()
+		}
+		if policy.exhausted(b.attempts, b.firstFailure) {
+			l.deadLetter(b, statusCode, response, "retries exhausted")
+			return sendRejected
+		}
+	}
+	return sendRetryable
+}
+
+// nextBatch dequeues items up to the max request size, nil when the queue is empty
+func (l *LogzioSender) nextBatch() *batch {
+	l.buf.Reset()
+	l.dequeueUpToMaxBatchSize()
+	if l.buf.Len() == 0 {
+		return nil
+	}
+	return &batch{data: append([]byte(nil), l.buf.Bytes()...)}
+}
+
+func (l *LogzioSender) dequeueUpToMaxBatchSize() {
+	for l.buf.Len() < maxSize {
+		item, err := l.queue.Dequeue()
+		if err != nil {
+			if err != goque.ErrEmpty {
+				l.debugLog("queue state: %s\n", err)
+			}
+			break
+		}
+		data, err := l.keyring.Open(item.Value)
+		if err != nil {
+			l.released(len(item.Value))
+			l.deadLetterSealed(item.Value, err.Error())
+			continue
+		}
+		// NewLine is appended tp item.Value
+		if len(data)+l.buf.Len()+1 >= maxSize && l.buf.Len() > 0 {
+			l.queue.Enqueue(item.Value)
+			break
+		}
+		l.released(len(item.Value))
+		if _, err := l.buf.Write(append(data, '\n')); err != nil {
+			l.errorLog("error writing to buffer %s", err)
+		}
+	}
+}
+
+// Sync drains the queue
+func (l *LogzioSender) Sync() error {
+	l.Drain()
+	return nil
+}
+
+func (l *LogzioSender) requeue(data []byte) {
+	// the new line is added back when the batch is dequeued
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	// the batch is decrypted at this point, so only its size is logged
+	if l.keyring != nil {
+		l.debugLog("sender.go: Requeue %d bytes sealed with key %s\n", len(data), l.keyring.CurrentKeyID())
+	} else {
+		l.debugLog("sender.go: Requeue %d bytes\n", len(data))
+	}
+	if err := l.Send(data); err != nil {
+		l.errorLog("could not requeue logs %s", err)
+	}
+}
+
+// Token returns the token the sender ships with
+func (l *LogzioSender) Token() string {
+	l.tokenMu.RLock()
+	defer l.tokenMu.RUnlock()
+	return l.token
+}
+
+// SetToken rotates the token, the logs already in the queue are shipped with the new one
+func (l *LogzioSender) SetToken(token string) {
+	l.tokenMu.Lock()
+	defer l.tokenMu.Unlock()
+	l.token = token
+}
+
+// mask hides the token, e.g. in errors that hold the url
+func (l *LogzioSender) mask(s string) string {
+	token := l.Token()
+	if token == "" {
+		return s
+	}
+	return strings.Replace(s, token, maskedToken, -1)
+}
+
+func (l *LogzioSender) debugLog(format string, a ...interface{}) {
+	if l.debug != nil {
+		fmt.Fprint(l.debug, l.mask(fmt.Sprintf(format, a...)))
+	}
+}
+
+func (l *LogzioSender) infoLog(format string, a ...interface{}) {
+	fmt.Fprint(os.Stderr, l.mask(fmt.Sprintf(format, a...)))
+}
+
+func (l *LogzioSender) errorLog(format string, a ...interface{}) {
+	fmt.Fprint(os.Stderr, l.mask(fmt.Sprintf(format, a...)))
+}
+
+func (l *LogzioSender) Write(p []byte) (n int, err error) {
+	return len(p), l.Send(p)
+}
+
+// CloseIdleConnections to close all remaining open connections
+func (l *LogzioSender) CloseIdleConnections() {
+	l.httpTransport.CloseIdleConnections()
+}
@@ -0,0 +1,90 @@
+package shipper
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskSpaceCheckFailsOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logzio-sender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := newQuotaTestSender(t, filepath.Join(dir, "queue"), "http://127.0.0.1:1", SetCheckDiskSpace(true))
+	defer l.Close()
+	// the usage of a missing directory can't be read, the concurrent sends turn the check off
+	l.dir = filepath.Join(dir, "missing")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Send([]byte("log")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if l.queue.Length() != 4 {
+		t.Fatalf("Expected the log to be queued, the queue has %d items", l.queue.Length())
+	}
+	if atomic.LoadInt32(&l.checkDiskSpace) != 0 {
+		t.Fatal("Expected the disk space check to be turned off")
+	}
+}
+
+func TestStopCutsTheBackoffShort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logzio-sender")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	requests := make(chan struct{}, 10)
+	listener := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- struct{}{}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer listener.Close()
+
+	policy := DefaultRetryPolicy()
+	policy.InitialBackoff = time.Hour
+	policy.MaxBackoff = time.Hour
+	policy.AttemptsPerDrain = 3
+	l := newQuotaTestSender(t, filepath.Join(dir, "queue"), listener.URL, SetRetryPolicy(policy))
+	if err := l.Send([]byte("log")); err != nil {
+		t.Fatal(err)
+	}
+	go l.Drain()
+	<-requests
+
+	// the drain waits an hour before its next attempt
+	stopped := make(chan struct{})
+	go func() {
+		l.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop waited for the backoff of the drain")
+	}
+	if len(requests) != 0 {
+		t.Fatalf("Expected no attempt after Stop, got %d", len(requests))
+	}
+
+	// the batch is kept for the next sender of the queue
+	l = newQuotaTestSender(t, filepath.Join(dir, "queue"), listener.URL)
+	defer l.Close()
+	if content := queueContent(t, l); len(content) != 1 || content[0] != "log" {
+		t.Fatalf("Expected the log to be queued again, got %v", content)
+	}
+}
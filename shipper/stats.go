@@ -0,0 +1,41 @@
+package shipper
+
+import "sync/atomic"
+
+// Stats is a snapshot of the sender counters
+type Stats struct {
+	QueueLength    uint64       `json:"queue_length"`
+	SentBatches    int64        `json:"sent_batches"`
+	FailedAttempts int64        `json:"failed_attempts"`
+	DeadLettered   int64        `json:"dead_lettered"`
+	DroppedLogs    int64        `json:"dropped_logs"`
+	QueueBytes     int64        `json:"queue_bytes"`
+	EvictedLogs    int64        `json:"evicted_logs"`
+	Breaker        BreakerStats `json:"breaker"`
+}
+
+// counters are updated atomically, so Stats doesn't wait for a running drain
+type counters struct {
+	sentBatches    int64
+	failedAttempts int64
+	deadLettered   int64
+	droppedLogs    int64
+	queueBytes     int64
+	evictedLogs    int64
+	// lostLogs are the logs dropped since the last sent batch, the next request reports them
+	lostLogs int64
+}
+
+// Stats returns the current counters of the sender
+func (l *LogzioSender) Stats() Stats {
+	return Stats{
+		QueueLength:    l.queue.Length(),
+		SentBatches:    atomic.LoadInt64(&l.counters.sentBatches),
+		FailedAttempts: atomic.LoadInt64(&l.counters.failedAttempts),
+		DeadLettered:   atomic.LoadInt64(&l.counters.deadLettered),
+		DroppedLogs:    atomic.LoadInt64(&l.counters.droppedLogs),
+		QueueBytes:     atomic.LoadInt64(&l.counters.queueBytes),
+		EvictedLogs:    atomic.LoadInt64(&l.counters.evictedLogs),
+		Breaker:        l.breaker.stats(),
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+const (
+	envStateFile     = "LOGZIO_STATE_FILE"
+	defaultStateFile = "/var/lib/logzio/state.json"
+)
+
+// driverState is what the driver was serving, saved to the state file so the queues of the senders
+// are drained after a plugin restart, even when their containers are gone
+type driverState struct {
+	Containers []containerState `json:"containers"`
+	Senders    []senderState    `json:"senders"`
+}
+
+type containerState struct {
+	ContainerID   string `json:"container_id"`
+	ContainerName string `json:"container_name"`
+	FIFO          string `json:"fifo"`
+	HashCode      string `json:"hash"`
+}
+
+// senderState keeps the log-opts the sender was created with, without logzio-token. Tokens are never
+// saved: the token is read again from its file or the plugin env, and TokenHash identifies a token
+// set in logzio-token when a container starts with it.
+type senderState struct {
+	HashCode    string            `json:"hash"`
+	Dir         string            `json:"dir"`
+	Config      map[string]string `json:"config"`
+	TokenSource string            `json:"token_source"`
+	TokenHash   string            `json:"token_hash"`
+}
+
+func stateFilePath() string {
+	if path, ok := os.LookupEnv(envStateFile); ok {
+		return path
+	}
+	return defaultStateFile
+}
+
+// state returns the containers and senders of the driver, d.mu must be held
+func (d *Driver) state() *driverState {
+	state := &driverState{Containers: []containerState{}, Senders: []senderState{}}
+	hashCodes := make(map[*shipper.LogzioSender]string)
+	for _, sc := range d.senders {
+		if sc.sender == nil {
+			continue
+		}
+		hashCodes[sc.sender] = sc.hashCode
+		state.Senders = append(state.Senders, senderState{
+			HashCode:    sc.hashCode,
+			Dir:         sc.info.Config[logzioDirPath],
+			Config:      withoutToken(sc.info.Config),
+			TokenSource: tokenSource(sc.info),
+			TokenHash:   hash(sc.sender.Token()),
+		})
+	}
+	state.Senders = append(state.Senders, d.queued...)
+	for file, lf := range d.logs {
+		state.Containers = append(state.Containers, containerState{
+			ContainerID:   lf.info.ContainerID,
+			ContainerName: lf.info.Name(),
+			FIFO:          file,
+			HashCode:      hashCodes[lf.logzioLogger.logzioSender],
+		})
+	}
+	sort.Slice(state.Containers, func(i, j int) bool { return state.Containers[i].FIFO < state.Containers[j].FIFO })
+	sort.Slice(state.Senders, func(i, j int) bool { return state.Senders[i].HashCode < state.Senders[j].HashCode })
+	return state
+}
+
+// saveState writes the state file, d.mu must be held. The file holds the log-opts, so only the plugin
+// can read it.
+func (d *Driver) saveState() {
+	if d.stateFile == "" {
+		return
+	}
+	data, err := json.MarshalIndent(d.state(), "", "  ")
+	if err != nil {
+		logrus.WithError(err).Error("Failed to encode the driver state")
+		return
+	}
+	if err := writeFileAtomic(d.stateFile, data, 0600); err != nil {
+		logrus.WithError(err).Errorf("Failed to save the driver state to %s", d.stateFile)
+	}
+}
+
+// writeFileAtomic replaces path with data, a crash leaves either the old or the new file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// withoutToken returns a copy of the log-opts without logzio-token
+func withoutToken(config map[string]string) map[string]string {
+	copied := make(map[string]string, len(config))
+	for key, value := range config {
+		if key != logzioToken {
+			copied[key] = value
+		}
+	}
+	return copied
+}
+
+func loadState(path string) (*driverState, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &driverState{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &driverState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("state file %s is not valid: %s\n", path, err)
+	}
+	return state, nil
+}
+
+// restoreState recreates the senders of the state file that still have queued logs. They drain in the
+// background like any sender, and the containers that start with the same token and dir use them.
+// Queues of the recorded dirs that have no sender in the state are drained too when their token is
+// found, and reported otherwise.
+func (d *Driver) restoreState() {
+	if d.stateFile == "" {
+		return
+	}
+	state, err := loadState(d.stateFile)
+	if err != nil {
+		logrus.Error(err)
+		return
+	}
+	for _, c := range state.Containers {
+		logrus.WithField("id", c.ContainerID).WithField("fifo", c.FIFO).
+			Debugf("%s: was serving container %s before the restart", driverName, c.ContainerName)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	known := make(map[string]bool)
+	dirs := make(map[string][]senderState)
+	for _, s := range state.Senders {
+		known[filepath.Join(s.Dir, s.HashCode)] = true
+		dirs[s.Dir] = append(dirs[s.Dir], s)
+		if err := d.restoreSender(s); err != nil {
+			logrus.WithError(err).Errorf("%s: failed to drain the queue %s of a previous run", driverName, filepath.Join(s.Dir, s.HashCode))
+		}
+	}
+	for dir, senders := range dirs {
+		queues, err := diskQueues(dir, "")
+		if err != nil {
+			continue
+		}
+		for _, queue := range queues {
+			path := filepath.Join(dir, queue)
+			if known[path] || pluginConfigs.isOutputQueue(dir, queue) {
+				continue
+			}
+			s, ok := orphanState(dir, queue, senders)
+			if !ok {
+				logrus.Warnf("%s: queue %s has no recorded sender and its token is not found, "+
+					"a container that starts with its token drains it, or replay it with the queue command", driverName, path)
+				continue
+			}
+			if err := d.restoreSender(s); err != nil {
+				logrus.WithError(err).Errorf("%s: failed to drain the queue %s of a previous run", driverName, path)
+			}
+		}
+	}
+	d.saveState()
+}
+
+// orphanState returns the state of a queue under dir that has no recorded sender, when its token is
+// one the recorded senders of dir or the plugin env read. The queue is drained with the log-opts
+// of the sender it belongs to.
+func orphanState(dir string, queue string, senders []senderState) (senderState, bool) {
+	var candidates []map[string]string
+	for _, s := range senders {
+		candidates = append(candidates, s.Config)
+	}
+	if len(senders) > 0 {
+		// the token of the plugin env, with the other log-opts of the dir
+		env := withoutToken(senders[0].Config)
+		delete(env, logzioTokenFile)
+		candidates = append(candidates, env)
+	}
+	for _, config := range candidates {
+		info := logger.Info{Config: config}
+		configured, err := getConfiguredToken(info)
+		if err != nil {
+			continue
+		}
+		if hash(configured, dir) == queue || hash(tokenRotations.resolve(configured), dir) == queue {
+			return senderState{HashCode: queue, Dir: dir, Config: config, TokenSource: tokenSource(info)}, true
+		}
+	}
+	return senderState{}, false
+}
+
+// restoreSender creates the sender of s when its queue still has logs, d.mu must be held.
+// State files of older versions have the token in the log-opts, it is used as is.
+func (d *Driver) restoreSender(s senderState) error {
+	path := filepath.Join(s.Dir, s.HashCode)
+	if !isDiskQueue(path) {
+		return nil
+	}
+	q, err := openDiskQueue(path)
+	if err != nil {
+		return err
+	}
+	length := q.Length()
+	q.Close()
+	if length == 0 {
+		return nil
+	}
+
+	if _, ok := s.Config[logzioToken]; !ok && s.TokenSource == logzioToken {
+		// the token is not saved, the queue waits for a container that starts with it
+		d.queued = append(d.queued, s)
+		logrus.Infof("%s: %d queued logs of a previous run in %s wait for a container with their token", driverName, length, path)
+		return nil
+	}
+	info := logger.Info{Config: s.Config}
+	token, err := getToken(info)
+	if err != nil {
+		return err
+	}
+	sender, err := newLogzioSender(info, token, nil, s.HashCode)
+	if err != nil {
+		return fmt.Errorf("error creating logzio sender: %s", maskToken(err.Error(), token))
+	}
+	logrus.Infof("%s: draining %d queued logs of a previous run from %s", driverName, length, path)
+	if _, exists := d.senders[token]; exists {
+		// the containers of the token use its other sender, this one is closed once its queue is empty
+		go drainAndClose(sender, getEnvDuration(envLogsDrainTimeout, defaultLogsDrainTimeout))
+		return nil
+	}
+	d.senders[token] = &SenderConfigurations{info: info, hashCode: s.HashCode, sender: sender}
+	go sender.Drain()
+	return nil
+}
+
+// drainAndClose drains the queue of a sender no container uses, and closes the sender once it is empty
+func drainAndClose(sender *shipper.LogzioSender, interval time.Duration) {
+	for {
+		sender.Drain()
+		if sender.Stats().QueueLength == 0 {
+			sender.Close()
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// takeQueuedHashCode returns the queue of a previous run that waits for one of the tokens in dir,
+// or hashCode when there is none
+func (d *Driver) takeQueuedHashCode(hashCode string, dir string, tokens ...string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, s := range d.queued {
+		if s.Dir != dir {
+			continue
+		}
+		for _, token := range tokens {
+			if token != "" && s.TokenHash == hash(token) {
+				d.queued = append(d.queued[:i], d.queued[i+1:]...)
+				return s.HashCode
+			}
+		}
+	}
+	return hashCode
+}
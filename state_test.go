@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+func TestMain(m *testing.M) {
+	// the drivers of the tests don't save their state to the plugin's state file
+	os.Setenv(envStateFile, "")
+	os.Exit(m.Run())
+}
+
+func newStateTestDriver(stateFile string) *Driver {
+	return &Driver{
+		logs:      make(map[string]*ContainerLoggersCtx),
+		idx:       make(map[string]*ContainerLoggersCtx),
+		senders:   make(map[string]*SenderConfigurations),
+		stateFile: stateFile,
+	}
+}
+
+func TestStateRestore(t *testing.T) {
+	dir, err := filepath.Abs(fmt.Sprintf("./%s", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener := newRecordingListener()
+	defer listener.Close()
+	stateFile := filepath.Join(dir, "state", "state.json")
+
+	// the first run queues logs and stops before draining them
+	os.Setenv(envLogsDrainTimeout, "1h")
+	defer os.Unsetenv(envLogsDrainTimeout)
+	tokenFile := writeTestFile(t, dir, "token", []byte("stateToken"))
+	info := logger.Info{
+		Config:      map[string]string{logzioTokenFile: tokenFile, logzioURL: listener.URL, logzioDirPath: dir},
+		ContainerID: "containeriid",
+	}
+	hashCode, err := validateDriverOpt(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := newLogzioSender(info, "stateToken", nil, hashCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := sender.Send([]byte(fmt.Sprintf(`{"message":"queued %d"}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := newStateTestDriver(stateFile)
+	d.senders["stateToken"] = &SenderConfigurations{info: info, hashCode: hashCode, sender: sender}
+	d.saveState()
+	sender.Close()
+
+	stat, err := os.Stat(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("Expected the state file to be readable by the plugin only, got %s", stat.Mode())
+	}
+	data, _ := ioutil.ReadFile(stateFile)
+	if !strings.Contains(string(data), hashCode) || strings.Contains(string(data), "stateToken") {
+		t.Fatalf("Expected the sender without its token in the state file:\n%s", data)
+	}
+
+	// an unknown queue in the same dir is reported, not drained
+	unknown, err := newLogzioSender(logger.Info{Config: map[string]string{logzioURL: listener.URL, logzioDirPath: dir}},
+		"otherToken", nil, "unknownhash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown.Send([]byte(`{"message":"unknown"}`))
+	unknown.Close()
+	// an unknown queue of the plugin env token is drained
+	os.Setenv(envToken, "envToken")
+	defer os.Unsetenv(envToken)
+	orphan, err := newLogzioSender(logger.Info{Config: map[string]string{logzioURL: listener.URL, logzioDirPath: dir}},
+		"envToken", nil, hash("envToken", dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan.Send([]byte(`{"message":"orphan"}`))
+	orphan.Close()
+
+	// the next run drains the queue with the recorded url, and the token read again from its file
+	os.Setenv(envLogsDrainTimeout, "100ms")
+	d = newStateTestDriver(stateFile)
+	d.restoreState()
+	restored, ok := d.senders["stateToken"]
+	if !ok {
+		t.Fatal("Expected the sender of the queue to be restored")
+	}
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+		if strings.Count(listener.Messages(), "queued") == 3 && strings.Contains(listener.Messages(), "orphan") {
+			break
+		}
+	}
+	messages := listener.Messages()
+	if strings.Count(messages, "queued") != 3 || !strings.Contains(messages, "orphan") || strings.Contains(messages, "unknown") {
+		t.Fatalf("Expected the recorded queue and the orphan of the env token to be drained, got:\n%s", messages)
+	}
+	if restored.sender.Stats().QueueLength != 0 {
+		t.Fatalf("Expected the queue to be empty, got %d", restored.sender.Stats().QueueLength)
+	}
+	restored.sender.Close()
+	d.senders["envToken"].sender.Close()
+
+	// an empty queue is not restored
+	d = newStateTestDriver(stateFile)
+	d.restoreState()
+	if len(d.senders) != 0 {
+		t.Fatalf("Expected no sender for a drained queue, got %v", d.senders)
+	}
+	if state, err := loadState(stateFile); err != nil || len(state.Senders) != 0 {
+		t.Fatalf("Expected the drained sender to leave the state file: %+v %v", state, err)
+	}
+}
+
+func TestStateRestoreInlineToken(t *testing.T) {
+	dir, err := filepath.Abs(fmt.Sprintf("./%s", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener := newRecordingListener()
+	defer listener.Close()
+	stateFile := filepath.Join(dir, "state", "state.json")
+
+	os.Setenv(envLogsDrainTimeout, "1h")
+	defer os.Unsetenv(envLogsDrainTimeout)
+	info := logger.Info{
+		Config:      map[string]string{logzioToken: "inlineToken", logzioURL: listener.URL, logzioDirPath: dir},
+		ContainerID: "containeriid",
+		LogPath:     filepath.Join(dir, "container.log"),
+	}
+	hashCode, err := validateDriverOpt(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := newLogzioSender(info, "inlineToken", nil, hashCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.Send([]byte(`{"message":"queued"}`))
+	d := newStateTestDriver(stateFile)
+	d.senders["inlineToken"] = &SenderConfigurations{info: info, hashCode: hashCode, sender: sender}
+	d.saveState()
+	sender.Close()
+	if data, _ := ioutil.ReadFile(stateFile); strings.Contains(string(data), "inlineToken") {
+		t.Fatalf("The token is in the state file:\n%s", data)
+	}
+
+	// the token can't be read again, the queue waits for a container with it
+	os.Setenv(envLogsDrainTimeout, "100ms")
+	d = newStateTestDriver(stateFile)
+	d.restoreState()
+	if len(d.senders) != 0 || len(d.queued) != 1 {
+		t.Fatalf("Expected the queue to wait for its token, got %v %v", d.senders, d.queued)
+	}
+	if state, err := loadState(stateFile); err != nil || len(state.Senders) != 1 {
+		t.Fatalf("Expected the waiting queue to stay in the state file: %+v %v", state, err)
+	}
+
+	file := filepath.Join(dir, "fifo")
+	writer := openTestFifo(t, file)
+	if err := d.StartLogging(file, info); err != nil {
+		t.Fatal(err)
+	}
+	w := <-writer
+	if w == nil {
+		t.FailNow()
+	}
+	defer d.StopLogging(file)
+	defer w.Close()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+		if strings.Contains(listener.Messages(), "queued") {
+			break
+		}
+	}
+	if !strings.Contains(listener.Messages(), "queued") || len(d.queued) != 0 {
+		t.Fatalf("Expected the container to drain the queue, got:\n%s", listener.Messages())
+	}
+}
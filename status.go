@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+// SenderStatus describes a sender and the containers using it
+type SenderStatus struct {
+	Hash       string        `json:"hash"`
+	URL        string        `json:"url"`
+	Containers []string      `json:"containers"`
+	Stats      shipper.Stats `json:"stats"`
+	// ChannelDropped and ChannelSpilled count the messages of running containers handled by the backpressure mode
+	ChannelDropped uint64 `json:"channel_dropped"`
+	ChannelSpilled uint64 `json:"channel_spilled"`
+}
+
+type StatusResponse struct {
+	Err     string
+	Senders []SenderStatus
+}
+
+// Status returns the state of every sender the driver created
+func (d *Driver) Status() []SenderStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var statuses []SenderStatus
+	for _, sc := range d.senders {
+		if sc.sender == nil {
+			continue
+		}
+		status := SenderStatus{
+			Hash:       sc.hashCode,
+			URL:        sc.info.Config[logzioURL],
+			Containers: []string{},
+			Stats:      sc.sender.Stats(),
+		}
+		for _, lf := range d.logs {
+			if lf.logzioLogger.logzioSender == sc.sender {
+				status.Containers = append(status.Containers, lf.info.ContainerID)
+				status.ChannelDropped += lf.logzioLogger.bpStats.Dropped()
+				status.ChannelSpilled += lf.logzioLogger.bpStats.Spilled()
+			}
+		}
+		sort.Strings(status.Containers)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Hash < statuses[j].Hash })
+	return statuses
+}
+
+// statusCommand prints the status of a running plugin, read from its socket
+func statusCommand(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	socket := flags.String("socket", socketName, "plugin socket, /run/docker/plugins/<plugin id>/logzio.sock on the host")
+	asJSON := flags.Bool("json", false, "print the raw json status")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", *socket)
+		},
+	}}
+	resp, err := client.Post("http://plugin/Logzio.Status", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var status StatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return err
+	}
+	if status.Err != "" {
+		return fmt.Errorf("%s", status.Err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status.Senders)
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "QUEUE\tURL\tCONTAINERS\tQUEUED\tBYTES\tSENT\tFAILED\tDEAD-LETTERED\tEVICTED\tDROPPED\tCHANNEL-DROPPED\tSPILLED\tBREAKER")
+	for _, s := range status.Senders {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%s\n", s.Hash, s.URL, len(s.Containers),
+			s.Stats.QueueLength, s.Stats.QueueBytes, s.Stats.SentBatches, s.Stats.FailedAttempts, s.Stats.DeadLettered,
+			s.Stats.EvictedLogs, s.Stats.DroppedLogs,
+			s.ChannelDropped, s.ChannelSpilled, s.Stats.Breaker.State)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beeker1121/goque"
+	"github.com/docker/docker/daemon/logger"
+	"github.com/docker/go-plugins-helpers/sdk"
+)
+
+func TestCircuitBreakerKeepsLogsOnDisk(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	info := logger.Info{
+		Config: map[string]string{
+			logzioURL:                 ts.URL,
+			logzioToken:               "123456789",
+			logzioDirPath:             dir,
+			logzioRetryInitialBackoff: "10ms",
+			logzioBreakerFailures:     "2",
+			logzioBreakerOpenTimeout:  "1h",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+	logziol, err := newLogzioLogger(info, nil, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logziol.Log(&logger.Message{Line: []byte(t.Name()), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDriver()
+	d.senders[info.Config[logzioToken]] = &SenderConfigurations{info: info, hashCode: "0", sender: logziol.logzioSender}
+	if err := logziol.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	if requests != 2 {
+		t.Fatalf("Expected the breaker to stop after 2 requests, got %d", requests)
+	}
+	mu.Unlock()
+	q, err := goque.OpenQueue(filepath.Join(dir, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Length() != 1 {
+		t.Fatalf("Queue length is not as expected: %d", q.Length())
+	}
+	q.Close()
+
+	status := d.Status()
+	if len(status) != 1 || status[0].Stats.Breaker.State != "open" || status[0].Stats.FailedAttempts != 2 {
+		t.Fatalf("Unexpected status %+v", status)
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	mock := NewtestHTTPMock(t, []int{http.StatusOK})
+	go mock.Serve()
+	defer mock.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	info := logger.Info{
+		Config: map[string]string{
+			logzioURL:     mock.URL(),
+			logzioToken:   mock.Token(),
+			logzioDirPath: dir,
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+	logziol, err := newLogzioLogger(info, nil, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logziol.Close()
+
+	d := newDriver()
+	d.senders[mock.Token()] = &SenderConfigurations{info: info, hashCode: "0", sender: logziol.logzioSender}
+	d.logs["fifo"] = &ContainerLoggersCtx{info: info, logzioLogger: &LogzioLogger{bpStats: logziol.bpStats,
+		logzioSender: logziol.logzioSender}}
+
+	socket, err := filepath.Abs(filepath.Join(dir, "logzio.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	h := sdk.NewHandler(`{"Implements": ["LoggingDriver"]}`)
+	handlers(&h, d)
+	go h.Serve(l)
+
+	var out bytes.Buffer
+	if err := statusCommand([]string{"--socket", socket}, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "0 ") || !strings.Contains(lines[1], mock.URL()) ||
+		!strings.Contains(lines[1], "closed") {
+		t.Fatalf("Unexpected status output:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := statusCommand([]string{"--socket", socket, "--json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"containeriid"`) || strings.Contains(out.String(), mock.Token()) {
+		t.Fatalf("Unexpected json status:\n%s", out.String())
+	}
+}
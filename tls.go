@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	//log-opt
+	logzioCACert        = "logzio-ca-cert"
+	logzioClientCert    = "logzio-client-cert"
+	logzioClientKey     = "logzio-client-key"
+	logzioTLSServerName = "logzio-tls-server-name"
+	logzioTLSMinVersion = "logzio-tls-min-version"
+
+	envCACert        = "LOGZIO_CA_CERT"
+	envClientCert    = "LOGZIO_CLIENT_CERT"
+	envClientKey     = "LOGZIO_CLIENT_KEY"
+	envTLSServerName = "LOGZIO_TLS_SERVER_NAME"
+	envTLSMinVersion = "LOGZIO_TLS_MIN_VERSION"
+
+	// TLS 1.3 is not supported by the crypto/tls of the go version the plugin is built with
+	unsupportedTLSVersion = "1.3"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+}
+
+// getOptOrEnv returns the log-opt value if set, otherwise the plugin level env value
+func getOptOrEnv(loggerInfo logger.Info, opt string, env string) string {
+	if value, ok := loggerInfo.Config[opt]; ok {
+		return value
+	}
+	return os.Getenv(env)
+}
+
+// getTLSConfig builds the TLS configuration of the listener connection.
+// It returns nil when none of the TLS options are set, so the sender keeps its default.
+func getTLSConfig(loggerInfo logger.Info) (*tls.Config, error) {
+	caCert := getOptOrEnv(loggerInfo, logzioCACert, envCACert)
+	clientCert := getOptOrEnv(loggerInfo, logzioClientCert, envClientCert)
+	clientKey := getOptOrEnv(loggerInfo, logzioClientKey, envClientKey)
+	serverName := getOptOrEnv(loggerInfo, logzioTLSServerName, envTLSServerName)
+	minVersion := getOptOrEnv(loggerInfo, logzioTLSMinVersion, envTLSMinVersion)
+
+	if caCert == "" && clientCert == "" && clientKey == "" && serverName == "" && minVersion == "" {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{ServerName: serverName}
+
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %s\n", logzioCACert, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s: %s\n", logzioCACert, caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (clientCert == "") != (clientKey == "") {
+		return nil, fmt.Errorf("%s and %s must be set together\n", logzioClientCert, logzioClientKey)
+	}
+	if clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %s\n", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if minVersion == unsupportedTLSVersion {
+		return nil, fmt.Errorf("%s %s is not supported by the go version the plugin is built with, use 1.2\n", logzioTLSMinVersion, minVersion)
+	}
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a supported %s, use one of: 1.0, 1.1, 1.2\n", minVersion, logzioTLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	return tlsConfig, nil
+}
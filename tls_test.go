@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *rsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, cn string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{cn},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+	}
+}
+
+func writeTestFile(t *testing.T, dir string, name string, data []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageAny)
+	caPath := writeTestFile(t, dir, "ca.pem", ca.certPEM)
+	notPEM := writeTestFile(t, dir, "bad.pem", []byte("not a certificate"))
+
+	tests := []struct {
+		name string
+		opts map[string]string
+		err  string
+	}{
+		{"valid", map[string]string{logzioCACert: caPath, logzioTLSMinVersion: "1.2", logzioTLSServerName: "relay"}, ""},
+		{"missing ca", map[string]string{logzioCACert: filepath.Join(dir, "missing.pem")}, "failed to read"},
+		{"not pem", map[string]string{logzioCACert: notPEM}, "no PEM certificates"},
+		{"cert without key", map[string]string{logzioClientCert: caPath}, "must be set together"},
+		{"bad key pair", map[string]string{logzioClientCert: caPath, logzioClientKey: notPEM}, "failed to load client certificate"},
+		{"bad version", map[string]string{logzioTLSMinVersion: "2.0"}, "not a supported"},
+		{"tls 1.3", map[string]string{logzioTLSMinVersion: "1.3"}, "not supported by the go version"},
+	}
+	for _, test := range tests {
+		conf := map[string]string{
+			logzioToken:   "logzioToken",
+			logzioDirPath: dir,
+		}
+		for k, v := range test.opts {
+			conf[k] = v
+		}
+		_, err := validateDriverOpt(logger.Info{ContainerID: "123456789", Config: conf})
+		if test.err == "" && err != nil {
+			t.Fatalf("%s: unexpected error %s", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Fatalf("%s: expected error containing %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestSendingMutualTLS(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil, x509.ExtKeyUsageAny)
+	server := newTestCert(t, "relay.internal", ca, x509.ExtKeyUsageServerAuth)
+	client := newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	serverPair, err := tls.X509KeyPair(server.certPEM, server.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 10)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverPair},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	info := logger.Info{
+		Config: map[string]string{
+			logzioURL:           ts.URL,
+			logzioToken:         "123456789",
+			logzioDirPath:       dir,
+			logzioCACert:        writeTestFile(t, dir, "ca.pem", ca.certPEM),
+			logzioClientCert:    writeTestFile(t, dir, "client.pem", client.certPEM),
+			logzioClientKey:     writeTestFile(t, dir, "client.key", client.keyPEM),
+			logzioTLSServerName: "relay.internal",
+			logzioTLSMinVersion: "1.2",
+		},
+		ContainerID:        "containeriid",
+		ContainerName:      "/container_name",
+		ContainerImageID:   "contaimageid",
+		ContainerImageName: "container_image_name",
+	}
+	if _, err := validateDriverOpt(info); err != nil {
+		t.Fatal(err)
+	}
+	logziol, err := newLogzioLogger(info, nil, "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := logziol.Log(&logger.Message{Line: []byte("over mtls"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := logziol.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case body := <-received:
+		if !strings.Contains(body, "over mtls") {
+			t.Fatalf("Unexpected body: %s", body)
+		}
+	default:
+		t.Fatal("Listener did not receive the log over mutual TLS")
+	}
+}
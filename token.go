@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/daemon/logger"
+)
+
+const (
+	//log-opt
+	logzioTokenFile = "logzio-token-file"
+
+	envToken                = "LOGZIO_TOKEN"
+	envTokenFile            = "LOGZIO_TOKEN_FILE"
+	envTokenRotationFile    = "LOGZIO_TOKEN_ROTATION_FILE"
+	envTokenRefreshInterval = "LOGZIO_TOKEN_REFRESH_INTERVAL"
+
+	defaultTokenRefreshInterval = time.Second * 30
+)
+
+// tokenRotations maps replaced tokens to the tokens replacing them, read from LOGZIO_TOKEN_ROTATION_FILE
+var tokenRotations = &rotationMap{}
+
+type rotationMap struct {
+	mu   sync.RWMutex
+	next map[string]string
+}
+
+// load reads "<old token>=<new token>" lines from path, an empty path clears the map
+func (r *rotationMap) load(path string) error {
+	next := make(map[string]string)
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %s\n", envTokenRotationFile, err)
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			parts := strings.SplitN(line, "=", 2)
+			if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+				return fmt.Errorf("%s line %d must be <old token>=<new token>\n", envTokenRotationFile, i+1)
+			}
+			next[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.next = next
+	return nil
+}
+
+// resolve follows the rotations of token, a rotation loop stops after every entry was used once
+func (r *rotationMap) resolve(token string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for i := 0; i < len(r.next); i++ {
+		next, ok := r.next[token]
+		if !ok {
+			break
+		}
+		token = next
+	}
+	return token
+}
+
+// getToken resolves the shipping token of a container, in order from logzio-token, logzio-token-file,
+// and the LOGZIO_TOKEN_FILE and LOGZIO_TOKEN plugin env. Only logzio-token shows in docker inspect.
+// A token replaced in LOGZIO_TOKEN_ROTATION_FILE resolves to its replacement.
+func getToken(loggerInfo logger.Info) (string, error) {
+	token, err := getConfiguredToken(loggerInfo)
+	if err != nil {
+		return "", err
+	}
+	return tokenRotations.resolve(token), nil
+}
+
+func getConfiguredToken(loggerInfo logger.Info) (string, error) {
+	if token, ok := loggerInfo.Config[logzioToken]; ok {
+		return token, nil
+	}
+	tokenFile, ok := loggerInfo.Config[logzioTokenFile]
+	if !ok {
+		tokenFile = os.Getenv(envTokenFile)
+	}
+	if tokenFile != "" {
+		return readTokenFile(tokenFile)
+	}
+	if token := os.Getenv(envToken); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("logz.io token is required\n")
+}
+
+// tokenSource names where getConfiguredToken reads the token of a container from
+func tokenSource(loggerInfo logger.Info) string {
+	if _, ok := loggerInfo.Config[logzioToken]; ok {
+		return logzioToken
+	}
+	if _, ok := loggerInfo.Config[logzioTokenFile]; ok {
+		return logzioTokenFile
+	}
+	if os.Getenv(envTokenFile) != "" {
+		return envTokenFile
+	}
+	return envToken
+}
+
+func readTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %s\n", logzioTokenFile, err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s %s is empty\n", logzioTokenFile, path)
+	}
+	return token, nil
+}
+
+// refreshTokensLoop rotates the tokens of the running senders every LOGZIO_TOKEN_REFRESH_INTERVAL
+func (d *Driver) refreshTokensLoop() {
+	interval := getEnvDuration(envTokenRefreshInterval, defaultTokenRefreshInterval)
+	for {
+		time.Sleep(interval)
+		d.refreshTokens()
+	}
+}
+
+// refreshTokens re-reads the token files and the rotation file, and swaps the token of every sender whose
+// token changed. The queued logs ship with the new token, and the sender is moved to the new token's key.
+// The state file then records the queue of the old token with the hash of the new one, so the queue is
+// drained with the new token after a restart.
+func (d *Driver) refreshTokens() {
+	if err := tokenRotations.load(os.Getenv(envTokenRotationFile)); err != nil {
+		logrus.Error(err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rotated := false
+	for oldToken, sc := range d.senders {
+		if sc.sender == nil {
+			continue
+		}
+		token, err := getToken(sc.info)
+		if err != nil {
+			logrus.WithField("queue", sc.hashCode).WithError(err).Error("Logz.io: failed to refresh the token")
+			continue
+		}
+		if token == sc.sender.Token() {
+			continue
+		}
+		sc.sender.SetToken(token)
+		rotated = true
+		logrus.WithField("queue", sc.hashCode).Info("Logz.io: rotated the token of the sender")
+		if _, taken := d.senders[token]; taken {
+			logrus.WithField("queue", sc.hashCode).Warn("Logz.io: another sender already uses the new token")
+			continue
+		}
+		delete(d.senders, oldToken)
+		d.senders[token] = sc
+	}
+	if rotated {
+		d.saveState()
+	}
+}
+
+// maskToken hides the token wherever it appears in s
+func maskToken(s string, token string) string {
+	if token == "" {
+		return s
+	}
+	return strings.Replace(s, token, maskedValue, -1)
+}
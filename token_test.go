@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/daemon/logger"
+	"github.com/logzio/logzio-logging-plugin/shipper"
+)
+
+func TestTokenResolution(t *testing.T) {
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	optFile := writeTestFile(t, dir, "opt-token", []byte("fromOptFile\n"))
+	envFile := writeTestFile(t, dir, "env-token", []byte("fromEnvFile"))
+	emptyFile := writeTestFile(t, dir, "empty-token", []byte(" \n"))
+
+	if _, err := getToken(logger.Info{}); err == nil {
+		t.Fatal("Expected an error without a token")
+	}
+	os.Setenv(envToken, "fromEnv")
+	defer os.Unsetenv(envToken)
+	os.Setenv(envTokenFile, envFile)
+	defer os.Unsetenv(envTokenFile)
+
+	tests := []struct {
+		config   map[string]string
+		expected string
+	}{
+		{map[string]string{logzioToken: "fromOpt", logzioTokenFile: optFile}, "fromOpt"},
+		{map[string]string{logzioTokenFile: optFile}, "fromOptFile"},
+		{map[string]string{}, "fromEnvFile"},
+	}
+	for _, test := range tests {
+		if token, err := getToken(logger.Info{Config: test.config}); err != nil || token != test.expected {
+			t.Fatalf("Expected token %s, got %s %v", test.expected, token, err)
+		}
+	}
+	os.Unsetenv(envTokenFile)
+	if token, _ := getToken(logger.Info{}); token != "fromEnv" {
+		t.Fatalf("Expected the env token, got %s", token)
+	}
+
+	for _, file := range []string{emptyFile, filepath.Join(dir, "missing")} {
+		if _, err := getToken(logger.Info{Config: map[string]string{logzioTokenFile: file}}); err == nil {
+			t.Fatalf("Expected an error for token file %s", file)
+		}
+	}
+
+	// the queue of a token file is the queue of the same plain token
+	fromFile, err := validateDriverOpt(logger.Info{Config: map[string]string{logzioTokenFile: optFile, logzioDirPath: dir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, _ := validateDriverOpt(logger.Info{Config: map[string]string{logzioToken: "fromOptFile", logzioDirPath: dir}})
+	if fromFile != plain {
+		t.Fatalf("Expected the same queue for the resolved token, got %s and %s", fromFile, plain)
+	}
+}
+
+func TestTokenMasked(t *testing.T) {
+	token := "s3cretToken"
+	if masked := maskConfig(map[string]string{logzioToken: token}); masked[logzioToken] != maskedValue {
+		t.Fatalf("Token is not masked: %v", masked)
+	}
+
+	dir := fmt.Sprintf("./%s", t.Name())
+	defer os.RemoveAll(dir)
+	ts := httptest.NewServer(nil)
+	ts.Close()
+	var debug bytes.Buffer
+	sender, err := shipper.New(token,
+		shipper.SetUrl(ts.URL),
+		shipper.SetDebug(&debug),
+		shipper.SetTempDirectory(dir),
+		shipper.SetRetryPolicy(shipper.RetryPolicy{Multiplier: 1, AttemptsPerDrain: 1, MaxAttempts: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.Send([]byte("log"))
+	sender.Stop()
+	if !strings.Contains(debug.String(), "Error sending logs") || strings.Contains(debug.String(), token) {
+		t.Fatalf("Token is not masked in the debug log:\n%s", debug.String())
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	var mu sync.Mutex
+	var tokens []string
+	up := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		tokens = append(tokens, r.URL.Query().Get("token"))
+		if !up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := writeTestFile(t, dir, "token", []byte("oldToken"))
+	info := logger.Info{
+		Config: map[string]string{
+			logzioURL:                 ts.URL,
+			logzioTokenFile:           tokenFile,
+			logzioDirPath:             dir,
+			logzioRetryInitialBackoff: "1ms",
+		},
+		ContainerID: "containeriid",
+	}
+	hashCode, err := validateDriverOpt(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logziol, err := newLogzioLogger(info, nil, hashCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDriver()
+	d.senders["oldToken"] = &SenderConfigurations{info: info, hashCode: hashCode, sender: logziol.logzioSender}
+	if err := logziol.Log(&logger.Message{Line: []byte("queued"), Source: "stdout", Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	logziol.logzioSender.Drain()
+
+	// the token file changed
+	writeTestFile(t, dir, "token", []byte("newToken\n"))
+	d.refreshTokens()
+	if _, ok := d.senders["oldToken"]; ok || d.senders["newToken"] == nil || logziol.logzioSender.Token() != "newToken" {
+		t.Fatalf("Sender was not moved to the new token: %v", d.senders)
+	}
+	mu.Lock()
+	up = true
+	mu.Unlock()
+	logziol.logzioSender.Drain()
+
+	// a plugin level rotation of the current token
+	rotationFile := writeTestFile(t, dir, "rotation", []byte("# rotated\nnewToken = thirdToken\n"))
+	os.Setenv(envTokenRotationFile, rotationFile)
+	defer os.Unsetenv(envTokenRotationFile)
+	defer tokenRotations.load("")
+	d.refreshTokens()
+	if d.senders["thirdToken"] == nil || logziol.logzioSender.Token() != "thirdToken" {
+		t.Fatalf("Sender was not moved to the rotated token: %v", d.senders)
+	}
+	// new containers started with a replaced token join the rotated sender
+	newInfo := logger.Info{Config: map[string]string{logzioToken: "oldToken", logzioDirPath: dir}}
+	tokenRotations.load(writeTestFile(t, dir, "rotation", []byte("oldToken=newToken\nnewToken=thirdToken\n")))
+	newHash, _ := validateDriverOpt(newInfo)
+	if token, _ := getToken(newInfo); token != "thirdToken" ||
+		d.checkHashCodeExists(newHash, token) != logziol.logzioSender {
+		t.Fatalf("Replaced token did not resolve to the rotated sender: %s", token)
+	}
+	logziol.Log(&logger.Message{Line: []byte("rotated"), Source: "stdout", Timestamp: time.Now()})
+	if err := logziol.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tokens) < 3 || tokens[0] != "oldToken" || tokens[len(tokens)-2] != "newToken" ||
+		tokens[len(tokens)-1] != "thirdToken" {
+		t.Fatalf("Unexpected tokens sent: %v", tokens)
+	}
+}
+
+func TestRefreshTokensDuringStartLogging(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	dir := fmt.Sprintf("./%s", t.Name())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := writeTestFile(t, dir, "token", []byte("token-0"))
+
+	d := newDriver()
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				d.refreshTokens()
+			}
+		}
+	}()
+	var files []string
+	var writers []*os.File
+	for i := 0; i < 5; i++ {
+		writeTestFile(t, dir, "token", []byte(fmt.Sprintf("token-%d", i/2)))
+		file := filepath.Join(dir, fmt.Sprintf("fifo-%d", i))
+		writer := openTestFifo(t, file)
+		info := logger.Info{
+			Config: map[string]string{
+				logzioURL:       ts.URL,
+				logzioTokenFile: tokenFile,
+				logzioDirPath:   dir,
+			},
+			ContainerID: fmt.Sprintf("containeriid%d", i),
+			LogPath:     filepath.Join(dir, fmt.Sprintf("container-%d.log", i)),
+		}
+		if err := d.StartLogging(file, info); err != nil {
+			t.Fatal(err)
+		}
+		w := <-writer
+		if w == nil {
+			t.FailNow()
+		}
+		files = append(files, file)
+		writers = append(writers, w)
+	}
+	close(done)
+	wg.Wait()
+
+	d.mu.Lock()
+	if len(d.logs) != len(files) || d.senders["token-2"] == nil {
+		t.Fatalf("Unexpected loggers %d and senders %v", len(d.logs), d.senders)
+	}
+	d.mu.Unlock()
+	for i, file := range files {
+		writers[i].Close()
+		d.StopLogging(file)
+	}
+}
+
+func TestTokenRotationSurvivesRestart(t *testing.T) {
+	dir, err := filepath.Abs(fmt.Sprintf("./%s", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listener := newRecordingListener()
+	defer listener.Close()
+	stateFile := filepath.Join(dir, "state", "state.json")
+
+	os.Setenv(envLogsDrainTimeout, "1h")
+	defer os.Unsetenv(envLogsDrainTimeout)
+	tokenFile := writeTestFile(t, dir, "token", []byte("oldToken"))
+	info := logger.Info{
+		Config:      map[string]string{logzioTokenFile: tokenFile, logzioURL: listener.URL, logzioDirPath: dir},
+		ContainerID: "containeriid",
+	}
+	hashCode, err := validateDriverOpt(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := newLogzioSender(info, "oldToken", nil, hashCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newStateTestDriver(stateFile)
+	d.senders["oldToken"] = &SenderConfigurations{info: info, hashCode: hashCode, sender: sender}
+	writeTestFile(t, dir, "token", []byte("newToken"))
+	d.refreshTokens()
+	sender.Send([]byte(`{"message":"queued"}`))
+	sender.Close()
+
+	// the queue of the old token is recorded with the hash of the new one
+	state, err := loadState(stateFile)
+	if err != nil || len(state.Senders) != 1 || state.Senders[0].HashCode != hashCode ||
+		state.Senders[0].TokenHash != hash("newToken") {
+		t.Fatalf("Unexpected state after the rotation %+v %v", state, err)
+	}
+
+	os.Setenv(envLogsDrainTimeout, "100ms")
+	d = newStateTestDriver(stateFile)
+	d.restoreState()
+	restored, ok := d.senders["newToken"]
+	if !ok || restored.hashCode != hashCode {
+		t.Fatalf("Expected the old queue to be restored with the new token: %v", d.senders)
+	}
+	defer restored.sender.Close()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(50 * time.Millisecond) {
+		if strings.Contains(listener.Messages(), "queued") {
+			break
+		}
+	}
+	if !strings.Contains(listener.Messages(), "queued") {
+		t.Fatal("Expected the old queue to be drained after the restart")
+	}
+	// the containers of the new token use the old queue
+	newHash, _ := validateDriverOpt(info)
+	if newHash == hashCode || d.checkHashCodeExists(newHash, "newToken") != restored.sender {
+		t.Fatal("Expected a container of the new token to use the restored sender")
+	}
+}